@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// bucketRule routes uploads matching all of its non-empty conditions to
+// Bucket. Rules are evaluated in order and the first match wins.
+type bucketRule struct {
+	Bucket            string `json:"bucket"`
+	ContentTypePrefix string `json:"content_type_prefix,omitempty"`
+	MinBytes          int64  `json:"min_bytes,omitempty"`
+}
+
+func parseBucketRules(raw string) ([]bucketRule, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var rules []bucketRule
+	err := json.Unmarshal([]byte(raw), &rules)
+	if err != nil {
+		return nil, fmt.Errorf("parse bucketRules err: %w", err)
+	}
+
+	for i, rule := range rules {
+		if rule.Bucket == "" {
+			return nil, fmt.Errorf("bucketRules[%d]: bucket is required", i)
+		}
+		if rule.ContentTypePrefix == "" && rule.MinBytes == 0 {
+			return nil, fmt.Errorf("bucketRules[%d]: at least one of content_type_prefix or min_bytes is required", i)
+		}
+	}
+
+	return rules, nil
+}
+
+func (r bucketRule) matches(meta FileMetadata) bool {
+	if r.ContentTypePrefix != "" && !strings.HasPrefix(meta.ContentType, r.ContentTypePrefix) {
+		return false
+	}
+	if r.MinBytes > 0 && meta.Bytes < r.MinBytes {
+		return false
+	}
+	return true
+}
+
+// bucketFor returns the bucket uploads of meta should be stored in.
+func (c *ssmConfig) bucketFor(meta FileMetadata) string {
+	for _, rule := range c.bucketRules {
+		if rule.matches(meta) {
+			return rule.Bucket
+		}
+	}
+	return c.bucket
+}
+
+// allBuckets returns the default bucket and every bucket named in a rule,
+// without duplicates.
+func (c *ssmConfig) allBuckets() []string {
+	buckets := []string{c.bucket}
+	seen := map[string]bool{c.bucket: true}
+	for _, rule := range c.bucketRules {
+		if !seen[rule.Bucket] {
+			seen[rule.Bucket] = true
+			buckets = append(buckets, rule.Bucket)
+		}
+	}
+	return buckets
+}
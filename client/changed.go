@@ -0,0 +1,58 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+)
+
+// ErrFileChanged is returned by Upload when the bytes read from the file
+// don't match the size and id it was requested with, e.g. because the
+// file was still being written. Nothing is stored for the file; S3
+// rejects the upload's sha256 checksum.
+var ErrFileChanged = errors.New("file changed during upload")
+
+// ErrIDMismatch is returned by Upload when the file has the expected size
+// but its sha256 isn't meta.ID. Either the file was rewritten in place or
+// the id was wrong to begin with, e.g. a stale entry in a precomputed ids
+// file; only the caller knows which.
+var ErrIDMismatch = errors.New("file content doesn't match its id")
+
+// changeCheckReader passes reads through while counting and hashing
+// them, failing the read that shows the file no longer matches its
+// expected size (ErrFileChanged) or id (ErrIDMismatch).
+type changeCheckReader struct {
+	r    io.Reader
+	size int64
+	id   string
+	n    int64
+	sum  hash.Hash
+	err  error
+}
+
+func newChangeCheckReader(r io.Reader, size int64, id string) *changeCheckReader {
+	return &changeCheckReader{r: r, size: size, id: id, sum: sha256.New()}
+}
+
+func (c *changeCheckReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	c.sum.Write(p[:n])
+	switch {
+	case c.n > c.size, err == io.EOF && c.n < c.size:
+		c.err = ErrFileChanged
+	case n > 0 && c.n == c.size && hex.EncodeToString(c.sum.Sum(nil)) != c.id:
+		// checked as soon as size bytes are read, since a POST form
+		// upload never reads to EOF
+		c.err = ErrIDMismatch
+	}
+	if c.err != nil {
+		return n, c.err
+	}
+	return n, err
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestChangeCheckReader(t *testing.T) {
+	data := []byte("the file as it was hashed")
+	id, err := ComputeID(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		read []byte
+		id   string
+		want error
+	}{
+		{"unchanged", data, id, nil},
+		{"grew", append(append([]byte{}, data...), " and more"...), id, ErrFileChanged},
+		{"shrank", data[:10], id, ErrFileChanged},
+		{"rewritten in place", bytes.ToUpper(data), id, ErrIDMismatch},
+		{"wrong id", data, "0000000000000000000000000000000000000000000000000000000000000000", ErrIDMismatch},
+	}
+	for _, tc := range tests {
+		cr := newChangeCheckReader(bytes.NewReader(tc.read), int64(len(data)), tc.id)
+		_, err := io.Copy(io.Discard, cr)
+		if !errors.Is(err, tc.want) || !errors.Is(cr.err, tc.want) {
+			t.Errorf("%s: err = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
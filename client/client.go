@@ -0,0 +1,549 @@
+// Package client implements the client side of the photo-backup upload
+// protocol: request a presigned upload destination from the server, then
+// PUT the file contents to it.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Client struct {
+	url      string
+	username string
+	password string
+
+	httpClient        *http.Client
+	retries           int
+	retryDelay        time.Duration
+	uploadTimeout     time.Duration
+	detectContentType bool
+	verifyAfterUpload bool
+
+	// bandwidth is the estimated upload speed in bytes per second, used
+	// to check a presigned URL will outlast an upload. Zero until set by
+	// WithUploadBandwidth or measured from an upload.
+	bwMu      sync.Mutex
+	bandwidth float64
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sets the http.Client used for all requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithRetries sets the number of times a failed upload will be retried.
+func WithRetries(n int, delay time.Duration) Option {
+	return func(c *Client) {
+		c.retries = n
+		c.retryDelay = delay
+	}
+}
+
+// WithUploadTimeout limits how long a single upload attempt may take.
+// A zero value means no limit.
+func WithUploadTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.uploadTimeout = d
+	}
+}
+
+// WithContentTypeDetection controls whether Upload sniffs the content-type
+// when FileMetadata.ContentType is empty. Defaults to true.
+func WithContentTypeDetection(detect bool) Option {
+	return func(c *Client) {
+		c.detectContentType = detect
+	}
+}
+
+// WithVerifyAfterUpload makes Upload HEAD the object after uploading it
+// and fail unless it exists with the expected size and id.
+func WithVerifyAfterUpload(verify bool) Option {
+	return func(c *Client) {
+		c.verifyAfterUpload = verify
+	}
+}
+
+// WithUploadBandwidth sets the initial upload speed estimate, in bytes
+// per second, that Upload uses to decide whether a presigned URL has
+// enough time left for a file. It is updated from measured uploads.
+func WithUploadBandwidth(bytesPerSecond int64) Option {
+	return func(c *Client) {
+		c.bandwidth = float64(bytesPerSecond)
+	}
+}
+
+// New returns a client for the upload_request endpoint at url.
+func New(url, username, password string, opts ...Option) *Client {
+	c := &Client{
+		url:               url,
+		username:          username,
+		password:          password,
+		httpClient:        http.DefaultClient,
+		retryDelay:        time.Second,
+		detectContentType: true,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Upload requests an upload destination for meta and uploads r to it.
+// If the server reports the file already exists, the returned
+// UploadDestination has Status StatusSkipUpload and nothing is uploaded.
+func (c *Client) Upload(ctx context.Context, r io.ReadSeeker, meta FileMetadata) (*UploadDestination, error) {
+	if meta.ContentType == "" && c.detectContentType {
+		contentType, err := DetectContentType(r)
+		if err != nil {
+			return nil, err
+		}
+		meta.ContentType = contentType
+	}
+
+	dest, err := c.RequestUploadURL(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	if dest.Status == StatusSkipUpload {
+		return dest, nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		if ro, ok := r.(interface{ Reopen() error }); ok && attempt > 0 {
+			err = ro.Reopen()
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err = r.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+
+		// checked before every attempt, the first included, since
+		// earlier attempts and retry delays use up the URL's validity
+		if !c.urlOutlastsUpload(dest, meta.Bytes) {
+			dest, err = c.RequestUploadURL(ctx, meta)
+			if err != nil {
+				return nil, err
+			}
+			if dest.Status == StatusSkipUpload {
+				return dest, nil
+			}
+		}
+
+		start := time.Now()
+		cr := newChangeCheckReader(r, meta.Bytes, meta.ID)
+		err = c.UploadFile(ctx, cr, meta.Bytes, dest)
+		if err == nil {
+			c.recordBandwidth(meta.Bytes, time.Since(start))
+		}
+		if err != nil && cr.err != nil {
+			// a retry would read the same changed file
+			return nil, fmt.Errorf("%s: %w", meta.Name, cr.err)
+		}
+		if err == nil || attempt >= c.retries || ctx.Err() != nil {
+			break
+		}
+
+		select {
+		case <-time.After(c.retryDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if c.verifyAfterUpload {
+		err = c.VerifyUpload(ctx, dest, meta)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dest.InboxKey != "" {
+		err = c.CompleteUpload(ctx, dest, meta)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if dest.Marker != nil {
+		dest.MarkerErr = c.WriteMarker(ctx, dest.Marker)
+	}
+
+	return dest, nil
+}
+
+const (
+	// urlExpiryMargin is how much validity a presigned URL must have left
+	// beyond the estimated upload time.
+	urlExpiryMargin = time.Minute
+
+	// minBandwidthSample is the smallest upload used to measure
+	// bandwidth; smaller ones are dominated by request latency.
+	minBandwidthSample = 1 << 20
+)
+
+// urlOutlastsUpload reports whether dest's URL stays valid long enough
+// to upload size bytes at the estimated bandwidth. It returns true when
+// either is unknown, since there is nothing better to do than try.
+func (c *Client) urlOutlastsUpload(dest *UploadDestination, size int64) bool {
+	c.bwMu.Lock()
+	bw := c.bandwidth
+	c.bwMu.Unlock()
+	if dest.ExpiresAt.IsZero() || bw <= 0 {
+		return true
+	}
+
+	need := time.Duration(float64(size) / bw * float64(time.Second))
+	if c.uploadTimeout > 0 && need > c.uploadTimeout {
+		need = c.uploadTimeout
+	}
+	return time.Until(dest.ExpiresAt) >= need+urlExpiryMargin
+}
+
+// recordBandwidth folds a completed upload into the bandwidth estimate.
+func (c *Client) recordBandwidth(size int64, d time.Duration) {
+	if size < minBandwidthSample || d <= 0 {
+		return
+	}
+	observed := float64(size) / d.Seconds()
+
+	c.bwMu.Lock()
+	defer c.bwMu.Unlock()
+	if c.bandwidth <= 0 {
+		c.bandwidth = observed
+		return
+	}
+	c.bandwidth = 0.7*c.bandwidth + 0.3*observed
+}
+
+// VerifyUpload checks that the object uploaded to dest exists with
+// meta's size and id.
+func (c *Client) VerifyUpload(ctx context.Context, dest *UploadDestination, meta FileMetadata) error {
+	if dest.VerifyURL == "" {
+		return fmt.Errorf("verify upload: server did not return a verify_url")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", dest.VerifyURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("verify upload: non-200 status code: %d", resp.StatusCode)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("content-length"), 10, 64)
+	if err != nil || size != meta.Bytes {
+		return fmt.Errorf("verify upload: stored size is %q, expected %d", resp.Header.Get("content-length"), meta.Bytes)
+	}
+	if id := resp.Header.Get("x-amz-meta-id"); id != meta.ID {
+		return fmt.Errorf("verify upload: stored id is %q, expected %s", id, meta.ID)
+	}
+	return nil
+}
+
+// WriteMarker writes the marker object for a completed upload.
+func (c *Client) WriteMarker(ctx context.Context, marker *MarkerDestination) error {
+	return c.UploadFile(ctx, strings.NewReader(marker.Body), int64(len(marker.Body)), &UploadDestination{
+		URL:     marker.URL,
+		Method:  marker.Method,
+		Headers: marker.Headers,
+	})
+}
+
+// copyBufPool holds the buffers used to hash files. They are larger than
+// io.Copy's default to cut the number of read syscalls per file.
+var copyBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 128<<10)
+		return &buf
+	},
+}
+
+// ComputeID returns the file id for the contents of r: the hex encoded
+// sha256 sum.
+func ComputeID(r io.Reader) (string, error) {
+	bufp := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(bufp)
+
+	summer := sha256.New()
+	// hide any WriterTo so CopyBuffer uses our buffer
+	_, err := io.CopyBuffer(summer, struct{ io.Reader }{r}, *bufp)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(summer.Sum(nil)), nil
+}
+
+// ParseID checks that s is a file id (a hex encoded sha256 sum) computed
+// elsewhere and returns it in the lowercase form the server expects.
+func ParseID(s string) (string, error) {
+	sum, err := hex.DecodeString(s)
+	if err != nil || len(sum) != sha256.Size {
+		return "", fmt.Errorf("invalid id %q: expected a hex encoded sha256 sum", s)
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// ComputeIDAndContentType returns the file id and sniffed content-type of
+// r in a single pass, without the seeks and extra read DetectContentType
+// needs. r is left at EOF.
+func ComputeIDAndContentType(r io.Reader) (string, string, error) {
+	bufp := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(bufp)
+	buf := *bufp
+
+	header := buf[:512]
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", "", err
+	}
+	contentType := http.DetectContentType(header[:n])
+
+	summer := sha256.New()
+	summer.Write(header[:n])
+	if n == len(header) {
+		_, err = io.CopyBuffer(summer, struct{ io.Reader }{r}, buf)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return hex.EncodeToString(summer.Sum(nil)), contentType, nil
+}
+
+// DetectContentType sniffs the content-type of r using
+// http.DetectContentType. r is left positioned at the start.
+func DetectContentType(r io.ReadSeeker) (string, error) {
+	_, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	// Files shorter than 512 bytes must only sniff the bytes that exist;
+	// trailing zeros can cause misdetection.
+	header := make([]byte, 512)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	return http.DetectContentType(header[:n]), nil
+}
+
+// UploadFile uploads size bytes from r to dest. The upload is aborted if it
+// takes longer than the configured upload timeout.
+func (c *Client) UploadFile(ctx context.Context, r io.Reader, size int64, dest *UploadDestination) error {
+	if c.uploadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.uploadTimeout)
+		defer cancel()
+	}
+
+	if dest.Method == "" {
+		dest.Method = "PUT"
+	}
+	if dest.Method == "POST" {
+		return c.uploadForm(ctx, r, size, dest)
+	}
+	req, err := http.NewRequestWithContext(ctx, dest.Method, dest.URL, r)
+	if err != nil {
+		return err
+	}
+
+	req.Header = dest.Headers.Clone()
+	req.ContentLength = size
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// drain the body so the connection can be reused
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("uploadFile: non-200 status code: %d\n%s\n", resp.StatusCode, body)
+	}
+
+	return nil
+}
+
+// RequestUploadURL asks the server for an upload destination for meta.
+func (c *Client) RequestUploadURL(ctx context.Context, meta FileMetadata) (*UploadDestination, error) {
+	if meta.Version == 0 {
+		meta.Version = ProtocolVersion
+	}
+	jsontxt, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(jsontxt)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("content-type", "application/json")
+	req.SetBasicAuth(c.username, c.password)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != http.StatusConflict {
+		return nil, newServerError(resp)
+	}
+
+	var dest UploadDestination
+	err = json.NewDecoder(resp.Body).Decode(&dest)
+	if err != nil {
+		return nil, err
+	}
+
+	// A 409 is the server telling us the file already exists. That is a
+	// final answer, not a retryable error.
+	if resp.StatusCode == http.StatusConflict && dest.Status != StatusSkipUpload {
+		return nil, fmt.Errorf("unexpected status %q in 409 response", dest.Status)
+	}
+
+	return &dest, nil
+}
+
+type UploadDestination struct {
+	Status    Status      `json:"status"`
+	Version   int         `json:"version"` // server protocol version; 0 from servers older than versioning
+	ErrorCode string      `json:"error_code,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Message   string      `json:"message,omitempty"`
+	Key       string      `json:"key,omitempty"`      // object key; the existing key for skip responses
+	Decision  string      `json:"decision,omitempty"` // validate_only requests only
+	URL       string      `json:"url"`
+	Method    string      `json:"method"`
+	Headers   http.Header `json:"headers"`
+
+	// VerifyURL is a presigned HEAD of the uploaded object, used by
+	// VerifyUpload.
+	VerifyURL string `json:"verify_url,omitempty"`
+
+	// Marker, if set, is the marker object Upload writes after a
+	// successful upload.
+	Marker *MarkerDestination `json:"marker,omitempty"`
+	// MarkerErr is the error writing Marker, if any. Markers are best
+	// effort so a failure doesn't fail the upload.
+	MarkerErr error `json:"-"`
+
+	// InboxKey, if set, is the staging key URL uploads to. Upload calls
+	// CompleteUpload to promote it to Key.
+	InboxKey string `json:"inbox_key,omitempty"`
+
+	// ExpiresAt is when the signature on URL expires; zero if the server
+	// didn't say. Upload requests a fresh URL when this is too soon for
+	// the file at the estimated bandwidth.
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+
+	// Fields are the form fields of a POST upload; UploadFile sends them
+	// before the file in a multipart/form-data body.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// MarkerDestination is a presigned PUT for an upload's marker object.
+type MarkerDestination struct {
+	Key     string      `json:"key"`
+	URL     string      `json:"url"`
+	Method  string      `json:"method"`
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body"`
+}
+
+type FileMetadata struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Mtime       time.Time `json:"mtime"`
+	Bytes       int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	TestUpload  bool      `json:"test_upload"`
+	Device      string    `json:"device,omitempty"` // originating device, e.g. hostname
+
+	// ValidateOnly asks the server to run all checks and return the
+	// decision and key without presigning an upload URL.
+	ValidateOnly bool `json:"validate_only,omitempty"`
+
+	// Extra is additional metadata the server stores as
+	// x-amz-meta-<key>.
+	Extra map[string]string `json:"extra,omitempty"`
+
+	// ExpireAfter is an optional Go duration after which the server
+	// marks the object for deletion.
+	ExpireAfter string `json:"expire_after,omitempty"`
+
+	// ThumbnailOf is the key of an uploaded original. If set, the file is
+	// stored as that original's thumbnail.
+	ThumbnailOf string `json:"thumbnail_of,omitempty"`
+
+	// PerceptualHash is an optional image hash from PerceptualHash that
+	// the server stores as the object's phash tag.
+	PerceptualHash string `json:"perceptual_hash,omitempty"`
+
+	// Album is an optional sub-prefix to store the upload under. The
+	// server rejects albums that aren't in its allowedAlbums.
+	Album string `json:"album,omitempty"`
+
+	// Version is the protocol version of the request. RequestUploadURL
+	// sets it to ProtocolVersion if it is zero.
+	Version int `json:"version,omitempty"`
+
+	// Method is "POST" to have the server return an S3 POST policy form
+	// instead of a presigned PUT, for environments that can only upload
+	// with form posts. Empty means PUT.
+	Method string `json:"method,omitempty"`
+}
+
+// ProtocolVersion is the upload_request protocol version this client
+// speaks. Servers reject versions they don't support with an
+// unsupported_protocol_version error.
+const ProtocolVersion = 1
+
+type Status string
+
+var (
+	StatusOK         Status = "ok"
+	StatusSkipUpload Status = "skip" // file already exists
+	StatusErr        Status = "error"
+)
@@ -0,0 +1,190 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tinyGIF is a complete 1x1 transparent GIF.
+var tinyGIF = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\xff\xff\xff!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+func TestDetectShortFiles(t *testing.T) {
+	var pngBuf bytes.Buffer
+	err := png.Encode(&pngBuf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"gif", tinyGIF, "image/gif"},
+		{"png", pngBuf.Bytes(), "image/png"},
+		{"text", []byte("hello"), "text/plain; charset=utf-8"},
+	}
+	for _, check := range checks {
+		t.Run(check.name, func(t *testing.T) {
+			if len(check.data) >= 512 {
+				t.Fatalf("test file is %d bytes, want under 512", len(check.data))
+			}
+
+			r := bytes.NewReader(check.data)
+			got, err := DetectContentType(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != check.want {
+				t.Errorf("DetectContentType = %q, want %q", got, check.want)
+			}
+			if pos, _ := r.Seek(0, io.SeekCurrent); pos != 0 {
+				t.Errorf("DetectContentType left r at %d", pos)
+			}
+
+			id, got, err := ComputeIDAndContentType(bytes.NewReader(check.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != check.want {
+				t.Errorf("ComputeIDAndContentType content-type = %q, want %q", got, check.want)
+			}
+			wantID, err := ComputeID(bytes.NewReader(check.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != wantID {
+				t.Errorf("ComputeIDAndContentType id = %s, want %s", id, wantID)
+			}
+		})
+	}
+}
+
+func TestRequestUploadURLConflict(t *testing.T) {
+	checks := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{"skip", `{"status": "skip", "version": 1, "message": "file already exists", "key": "photos/existing.jpg"}`, false},
+		{"not a skip", `{"status": "ok", "url": "http://example.com/put"}`, true},
+		{"malformed", `{"status": `, true},
+	}
+	for _, check := range checks {
+		t.Run(check.name, func(t *testing.T) {
+			var requests int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.Header().Set("content-type", "application/json")
+				w.WriteHeader(http.StatusConflict)
+				io.WriteString(w, check.body)
+			}))
+			defer ts.Close()
+
+			c := New(ts.URL, "user", "pass", WithRetries(3, 0))
+			data := []byte("an existing file")
+			id, err := ComputeID(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dest, err := c.Upload(context.Background(), bytes.NewReader(data), FileMetadata{
+				ID:    id,
+				Name:  "existing.jpg",
+				Bytes: int64(len(data)),
+			})
+			if n := atomic.LoadInt32(&requests); n != 1 {
+				t.Errorf("server got %d requests, want 1", n)
+			}
+			if check.wantErr {
+				if err == nil {
+					t.Fatalf("got destination %+v, want an error", dest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dest.Status != StatusSkipUpload || dest.Key != "photos/existing.jpg" || !strings.Contains(dest.Message, "already exists") {
+				t.Errorf("destination = %+v, want a skip with the existing key and message", dest)
+			}
+		})
+	}
+}
+
+func TestUploadRefreshesShortURL(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1000)
+	id, err := ComputeID(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		name         string
+		bandwidth    int64 // bytes per second
+		wantRequests int32
+		wantPut      string
+	}{
+		// 1000 bytes at 10B/s needs 100s plus the margin, more than the
+		// first URL's 2 minutes
+		{"slow upload gets a fresh url", 10, 2, "/put/2"},
+		{"fast upload keeps the url", 1 << 20, 1, "/put/1"},
+		{"unknown bandwidth keeps the url", 0, 1, "/put/1"},
+	}
+	for _, check := range checks {
+		t.Run(check.name, func(t *testing.T) {
+			var (
+				requests int32
+				put      atomic.Value
+			)
+			var ts *httptest.Server
+			ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "PUT" {
+					put.Store(r.URL.Path)
+					io.Copy(io.Discard, r.Body)
+					return
+				}
+				n := atomic.AddInt32(&requests, 1)
+				// the first URL is short, later ones last an hour
+				expiry := 2 * time.Minute
+				if n > 1 {
+					expiry = time.Hour
+				}
+				json.NewEncoder(w).Encode(UploadDestination{
+					Status:    StatusOK,
+					URL:       fmt.Sprintf("%s/put/%d", ts.URL, n),
+					Method:    "PUT",
+					ExpiresAt: time.Now().Add(expiry),
+				})
+			}))
+			defer ts.Close()
+
+			c := New(ts.URL+"/upload_request", "user", "pass", WithUploadBandwidth(check.bandwidth))
+			_, err := c.Upload(context.Background(), bytes.NewReader(data), FileMetadata{
+				ID:          id,
+				Name:        "a.jpg",
+				Bytes:       int64(len(data)),
+				ContentType: "image/jpeg",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := atomic.LoadInt32(&requests); n != check.wantRequests {
+				t.Errorf("%d upload url requests, want %d", n, check.wantRequests)
+			}
+			if got, _ := put.Load().(string); got != check.wantPut {
+				t.Errorf("uploaded to %q, want %q", got, check.wantPut)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"context"
+	"fmt"
+)
+
+type uploadCompleteRequest struct {
+	ID       string `json:"id"`
+	InboxKey string `json:"inbox_key"`
+}
+
+// UploadCompleteResponse is the server's response to /upload_complete.
+type UploadCompleteResponse struct {
+	Status  Status `json:"status"`
+	Message string `json:"message,omitempty"`
+	Key     string `json:"key"`
+}
+
+// CompleteUpload asks the server to promote an upload staged at
+// dest.InboxKey to its final key. It is safe to call again after a
+// failure; the server reports success for uploads already promoted.
+func (c *Client) CompleteUpload(ctx context.Context, dest *UploadDestination, meta FileMetadata) error {
+	endpoint, err := c.endpoint("upload_complete")
+	if err != nil {
+		return err
+	}
+
+	var complete UploadCompleteResponse
+	err = c.postJSON(ctx, endpoint, uploadCompleteRequest{
+		ID:       meta.ID,
+		InboxKey: dest.InboxKey,
+	}, &complete)
+	if err != nil {
+		return fmt.Errorf("complete upload: %w", err)
+	}
+	if complete.Key != dest.Key {
+		return fmt.Errorf("complete upload: promoted to %q, expected %q", complete.Key, dest.Key)
+	}
+	return nil
+}
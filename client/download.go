@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// MaxDownloadBatch is the most keys the server accepts in one
+// DownloadURLs call.
+const MaxDownloadBatch = 1000
+
+type downloadBatchRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// DownloadURL is a presigned GET for a stored object.
+type DownloadURL struct {
+	Key string `json:"key"`
+	URL string `json:"url"`
+}
+
+// DownloadBatchResponse is the server's response to /download_batch.
+type DownloadBatchResponse struct {
+	Status    Status        `json:"status"`
+	URLs      []DownloadURL `json:"urls"`
+	ExpiresAt time.Time     `json:"expires_at"`
+}
+
+// DownloadURLs asks the server for presigned GET URLs for up to
+// MaxDownloadBatch keys. The server rejects the whole batch if any key is
+// outside the caller's prefix.
+func (c *Client) DownloadURLs(ctx context.Context, keys []string) (*DownloadBatchResponse, error) {
+	endpoint, err := c.endpoint("download_batch")
+	if err != nil {
+		return nil, err
+	}
+
+	var resp DownloadBatchResponse
+	err = c.postJSON(ctx, endpoint, downloadBatchRequest{Keys: keys}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// OpenDownload GETs a presigned download URL. The caller must close the
+// returned body.
+func (c *Client) OpenDownload(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET download: status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ServerError is returned when the server responds with an error status.
+// Code and Message are taken from the JSON error body when there is one.
+type ServerError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// Decision is "would-reject" when a validate_only request failed
+	// validation.
+	Decision string
+	// RetryAfter is the server's Retry-After, if it sent one.
+	RetryAfter time.Duration
+}
+
+func (e *ServerError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("non-200 status code: %d", e.StatusCode)
+	}
+	return fmt.Sprintf("non-200 status code: %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func newServerError(resp *http.Response) *ServerError {
+	serr := ServerError{
+		StatusCode: resp.StatusCode,
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("retry-after")); err == nil && secs > 0 {
+		serr.RetryAfter = time.Duration(secs) * time.Second
+	}
+
+	var body struct {
+		ErrorCode string `json:"error_code"`
+		Error     string `json:"error"`
+		Decision  string `json:"decision"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body) == nil {
+		serr.Code = body.ErrorCode
+		serr.Message = body.Error
+		serr.Decision = body.Decision
+	}
+	return &serr
+}
+
+// IsReadOnly reports whether err is the server refusing uploads during a
+// read-only maintenance window. Callers should stop and retry later
+// rather than treat the file as failed.
+func IsReadOnly(err error) bool {
+	var serr *ServerError
+	return errors.As(err, &serr) && serr.StatusCode == http.StatusServiceUnavailable && serr.Code == "read_only"
+}
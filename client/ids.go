@@ -0,0 +1,129 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+)
+
+// IDsResponse is a page of file ids known to the server. Packs are the
+// keys of tar packs in the page, whose files' ids are only listed in the
+// pack manifest.
+type IDsResponse struct {
+	IDs       []string `json:"ids"`
+	Packs     []string `json:"packs,omitempty"`
+	NextToken string   `json:"next_token,omitempty"`
+}
+
+// ListIDs fetches one page of the ids the server already has. Pass the
+// previous page's NextToken to continue; an empty token starts from the
+// beginning.
+func (c *Client) ListIDs(ctx context.Context, token string) (*IDsResponse, error) {
+	endpoint, err := c.endpoint("ids")
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		endpoint += "?token=" + neturl.QueryEscape(token)
+	}
+
+	var resp IDsResponse
+	err = c.getJSON(ctx, endpoint, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// KnownIDs fetches every id the server already has.
+func (c *Client) KnownIDs(ctx context.Context) (map[string]bool, error) {
+	ids, _, err := c.KnownObjects(ctx)
+	return ids, err
+}
+
+// KnownObjects fetches every id the server already has, along with the
+// keys of any packs.
+func (c *Client) KnownObjects(ctx context.Context) (map[string]bool, []string, error) {
+	ids := make(map[string]bool)
+	var (
+		packs []string
+		token string
+	)
+	for {
+		page, err := c.ListIDs(ctx, token)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, id := range page.IDs {
+			ids[id] = true
+		}
+		packs = append(packs, page.Packs...)
+		if page.NextToken == "" {
+			return ids, packs, nil
+		}
+		token = page.NextToken
+	}
+}
+
+// endpoint returns the URL of another server endpoint, resolved relative
+// to the upload_request URL the client was configured with.
+func (c *Client) endpoint(name string) (string, error) {
+	base, err := neturl.Parse(c.url)
+	if err != nil {
+		return "", err
+	}
+	ref, err := neturl.Parse(name)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+func (c *Client) getJSON(ctx context.Context, endpoint string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.username, c.password)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("GET %s: %w", req.URL.Path, newServerError(resp))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) postJSON(ctx context.Context, endpoint string, in, out interface{}) error {
+	jsontxt, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(jsontxt))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("content-type", "application/json")
+	req.SetBasicAuth(c.username, c.password)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("POST %s: %w", req.URL.Path, newServerError(resp))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
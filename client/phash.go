@@ -0,0 +1,75 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+// dHash grid size. Each row of 9 cells gives 8 left/right comparisons.
+const (
+	dHashWidth  = 9
+	dHashHeight = 8
+
+	// dHashSamples is the max number of source pixels sampled along
+	// each axis of a cell, which bounds the cost for large images.
+	dHashSamples = 16
+)
+
+// PerceptualHash returns the hex encoded 64 bit difference hash (dHash)
+// of a gif, jpeg or png image. Re-encodes of the same picture, e.g. at a
+// different quality or size, give hashes a small Hamming distance apart.
+func PerceptualHash(r io.Reader) (string, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return "", err
+	}
+	b := img.Bounds()
+	if b.Dx() < dHashWidth || b.Dy() < dHashHeight {
+		return "", errors.New("image too small to hash")
+	}
+
+	var cells [dHashHeight][dHashWidth]float64
+	for cy := 0; cy < dHashHeight; cy++ {
+		y0 := b.Min.Y + cy*b.Dy()/dHashHeight
+		y1 := b.Min.Y + (cy+1)*b.Dy()/dHashHeight
+		for cx := 0; cx < dHashWidth; cx++ {
+			x0 := b.Min.X + cx*b.Dx()/dHashWidth
+			x1 := b.Min.X + (cx+1)*b.Dx()/dHashWidth
+			cells[cy][cx] = meanLuma(img, x0, x1, y0, y1)
+		}
+	}
+
+	var h uint64
+	for cy := 0; cy < dHashHeight; cy++ {
+		for cx := 0; cx < dHashWidth-1; cx++ {
+			h <<= 1
+			if cells[cy][cx] > cells[cy][cx+1] {
+				h |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", h), nil
+}
+
+// meanLuma averages the luma of up to dHashSamples x dHashSamples evenly
+// spaced pixels of the [x0, x1) x [y0, y1) block of img.
+func meanLuma(img image.Image, x0, x1, y0, y1 int) float64 {
+	xStep := (x1 - x0 + dHashSamples - 1) / dHashSamples
+	yStep := (y1 - y0 + dHashSamples - 1) / dHashSamples
+
+	var sum float64
+	var n int
+	for y := y0; y < y1; y += yStep {
+		for x := x0; x < x1; x += xStep {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	return sum / float64(n)
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"sort"
+)
+
+// uploadForm uploads size bytes from r as the file of an S3 POST policy
+// form. The multipart framing around the file is built up front so the
+// request has a known content-length and the file is still streamed.
+func (c *Client) uploadForm(ctx context.Context, r io.Reader, size int64, dest *UploadDestination) error {
+	var head bytes.Buffer
+	mw := multipart.NewWriter(&head)
+
+	names := make([]string, 0, len(dest.Fields))
+	for k := range dest.Fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		err := mw.WriteField(k, dest.Fields[k])
+		if err != nil {
+			return err
+		}
+	}
+	// S3 ignores any fields after the file
+	_, err := mw.CreateFormFile("file", path.Base(dest.Key))
+	if err != nil {
+		return err
+	}
+	headLen := head.Len()
+	err = mw.Close()
+	if err != nil {
+		return err
+	}
+	tail := append([]byte(nil), head.Bytes()[headLen:]...)
+	head.Truncate(headLen)
+
+	body := io.MultiReader(&head, io.LimitReader(r, size), bytes.NewReader(tail))
+	req, err := http.NewRequestWithContext(ctx, "POST", dest.URL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", mw.FormDataContentType())
+	req.ContentLength = int64(headLen) + size + int64(len(tail))
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	}
+	respBody, _ := io.ReadAll(resp.Body)
+	return fmt.Errorf("uploadForm: non-2xx status code: %d\n%s\n", resp.StatusCode, respBody)
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// ReopenReader is an upload body backed by a file on disk. Upload
+// reopens it before every retry attempt, so a retried PUT reads from a
+// fresh file handle without buffering the file in memory or a temp file.
+type ReopenReader struct {
+	path string
+	f    *os.File
+	stat os.FileInfo
+}
+
+// OpenFile opens path as a ReopenReader.
+func OpenFile(path string) (*ReopenReader, error) {
+	r := &ReopenReader{path: path}
+	err := r.Reopen()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reopen closes the file and opens path again, positioned at the start.
+// It fails with ErrFileChanged if the file's size is no longer the size it
+// had when first opened.
+func (r *ReopenReader) Reopen() error {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if r.stat != nil && stat.Size() != r.stat.Size() {
+		f.Close()
+		return fmt.Errorf("%s: size %d, expected %d: %w", r.path, stat.Size(), r.stat.Size(), ErrFileChanged)
+	}
+
+	if r.f != nil {
+		r.f.Close()
+	}
+	r.f = f
+	if r.stat == nil {
+		r.stat = stat
+	}
+	return nil
+}
+
+func (r *ReopenReader) Read(p []byte) (int, error) { return r.f.Read(p) }
+
+func (r *ReopenReader) Seek(offset int64, whence int) (int64, error) {
+	return r.f.Seek(offset, whence)
+}
+
+func (r *ReopenReader) Close() error { return r.f.Close() }
+
+// Size is the size of the file when it was first opened.
+func (r *ReopenReader) Size() int64 { return r.stat.Size() }
+
+// ModTime is the mtime of the file when it was first opened.
+func (r *ReopenReader) ModTime() time.Time { return r.stat.ModTime() }
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+type runManifestRequest struct {
+	Prefix string `json:"prefix"`
+	Name   string `json:"name"`
+	ID     string `json:"id"`
+	Bytes  int64  `json:"size"`
+}
+
+// WriteRunManifest stores body, a JSON summary of a batch run, as name
+// under prefix in the server's run manifest prefix. It returns the key
+// the manifest was written to.
+func (c *Client) WriteRunManifest(ctx context.Context, prefix, name string, body []byte) (string, error) {
+	endpoint, err := c.endpoint("run_manifest")
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(body)
+	var dest UploadDestination
+	err = c.postJSON(ctx, endpoint, runManifestRequest{
+		Prefix: prefix,
+		Name:   name,
+		ID:     hex.EncodeToString(sum[:]),
+		Bytes:  int64(len(body)),
+	}, &dest)
+	if err != nil {
+		return "", fmt.Errorf("run manifest request: %w", err)
+	}
+
+	err = c.UploadFile(ctx, bytes.NewReader(body), int64(len(body)), &dest)
+	if err != nil {
+		return "", err
+	}
+	return dest.Key, nil
+}
@@ -0,0 +1,15 @@
+package main
+
+import "time"
+
+// Clock is the source of the current time for the server. Tests can
+// substitute a fixed clock to make time-dependent behavior deterministic.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ssmConfig is the server configuration loaded from SSM.
+type ssmConfig struct {
+	bucket      string
+	pathPrefix  string
+	bcryptPass  string
+	bucketRules []bucketRule
+
+	// objectLockMode, if set, is the Object Lock retention mode applied
+	// to uploads with an expiry.
+	objectLockMode string
+
+	// timeFormat is the Go time layout of the key timestamp.
+	timeFormat string
+
+	// extensionCheck is what to do when an upload's name extension
+	// doesn't match its content-type: off, warn or reject.
+	extensionCheck string
+
+	// idShardChars is the number of leading id characters inserted as
+	// two character path segments before the key's file name (0 disables).
+	idShardChars int
+
+	// markerPrefix, if set, is the prefix clients write a marker object
+	// under after each successful upload.
+	markerPrefix string
+
+	// inboxPrefix, if set, is where uploads are PUT under a dated
+	// prefix before /upload_complete promotes them to their final key.
+	inboxPrefix string
+
+	// runManifestPrefix, if set, is where clients store a manifest of
+	// each batch run through /run_manifest.
+	runManifestPrefix string
+
+	// allowedNets, if set, are the client networks allowed to reach the
+	// server in http mode.
+	allowedNets []*net.IPNet
+
+	// readOnly rejects new uploads with a 503 during maintenance.
+	readOnly bool
+
+	// accelerate presigns URLs against the S3 Transfer Acceleration
+	// endpoint. The buckets must have acceleration enabled.
+	accelerate bool
+
+	// maxUploadBytes, if set, is the largest upload accepted for types
+	// without an entry in typeMaxUploadBytes.
+	maxUploadBytes int64
+
+	// typeMaxUploadBytes maps a top-level content-type to the largest
+	// upload accepted for it.
+	typeMaxUploadBytes map[string]int64
+
+	// allowedAlbums are the sub-prefixes clients may ask for with the
+	// album field. Uploads for other albums are rejected.
+	allowedAlbums []string
+
+	// typePrefixes maps a top-level content-type (image, video, ...) to
+	// the sub-prefix its uploads are stored under.
+	typePrefixes map[string]string
+}
+
+// maxIDShardChars limits sharding to 8 levels of 256 prefixes each.
+const maxIDShardChars = 16
+
+func loadSSMConfig(kv *kv) (*ssmConfig, error) {
+	var (
+		conf ssmConfig
+		err  error
+	)
+
+	conf.bucket, err = kv.get("bucket")
+	if err != nil {
+		return nil, err
+	}
+	rawPrefix, err := kv.get("pathPrefix")
+	if err != nil {
+		return nil, err
+	}
+	conf.pathPrefix = normalizePrefix(rawPrefix)
+	if conf.pathPrefix != rawPrefix {
+		log15.Warn("path_prefix_normalized", "raw", rawPrefix, "normalized", conf.pathPrefix)
+	}
+
+	bucketRulesJSON, err := kv.getOptional("bucketRules")
+	if err != nil {
+		return nil, err
+	}
+	conf.bucketRules, err = parseBucketRules(bucketRulesJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.objectLockMode, err = kv.getOptional("objectLockMode")
+	if err != nil {
+		return nil, err
+	}
+	switch conf.objectLockMode {
+	case "", "GOVERNANCE", "COMPLIANCE":
+	default:
+		return nil, fmt.Errorf("invalid objectLockMode %q, expected GOVERNANCE or COMPLIANCE", conf.objectLockMode)
+	}
+
+	timeFormat, err := kv.getOptional("timeFormat")
+	if err != nil {
+		return nil, err
+	}
+	conf.timeFormat, err = parseTimeFormat(timeFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.extensionCheck, err = kv.getOptional("extensionCheck")
+	if err != nil {
+		return nil, err
+	}
+	switch conf.extensionCheck {
+	case "":
+		conf.extensionCheck = extensionCheckWarn
+	case extensionCheckOff, extensionCheckWarn, extensionCheckReject:
+	default:
+		return nil, fmt.Errorf("invalid extensionCheck %q, expected off, warn or reject", conf.extensionCheck)
+	}
+
+	shardChars, err := kv.getOptional("idShardChars")
+	if err != nil {
+		return nil, err
+	}
+	if shardChars != "" {
+		conf.idShardChars, err = strconv.Atoi(shardChars)
+		if err != nil || conf.idShardChars < 0 || conf.idShardChars > maxIDShardChars || conf.idShardChars%2 != 0 {
+			return nil, fmt.Errorf("invalid idShardChars %q, expected an even number from 0 to %d", shardChars, maxIDShardChars)
+		}
+	}
+
+	rawMarkerPrefix, err := kv.getOptional("markerPrefix")
+	if err != nil {
+		return nil, err
+	}
+	if rawMarkerPrefix != "" {
+		conf.markerPrefix = normalizePrefix(rawMarkerPrefix)
+		if conf.markerPrefix == "" {
+			return nil, fmt.Errorf("invalid markerPrefix %q", rawMarkerPrefix)
+		}
+		if conf.pathPrefix == "" || strings.HasPrefix(conf.markerPrefix+"/", conf.listPrefix()) {
+			// listings of stored uploads skip it, see storedKey
+			log15.Warn("marker_prefix_inside_path_prefix", "marker_prefix", conf.markerPrefix, "path_prefix", conf.pathPrefix)
+		}
+	}
+
+	rawInboxPrefix, err := kv.getOptional("inboxPrefix")
+	if err != nil {
+		return nil, err
+	}
+	if rawInboxPrefix != "" {
+		conf.inboxPrefix = normalizePrefix(rawInboxPrefix)
+		if conf.inboxPrefix == "" {
+			return nil, fmt.Errorf("invalid inboxPrefix %q", rawInboxPrefix)
+		}
+		if conf.pathPrefix == "" || strings.HasPrefix(conf.inboxPrefix+"/", conf.listPrefix()) {
+			// listings of stored uploads skip it, see storedKey
+			log15.Warn("inbox_prefix_inside_path_prefix", "inbox_prefix", conf.inboxPrefix, "path_prefix", conf.pathPrefix)
+		}
+	}
+
+	rawRunManifestPrefix, err := kv.getOptional("runManifestPrefix")
+	if err != nil {
+		return nil, err
+	}
+	if rawRunManifestPrefix != "" {
+		conf.runManifestPrefix = normalizePrefix(rawRunManifestPrefix)
+		if conf.runManifestPrefix == "" {
+			return nil, fmt.Errorf("invalid runManifestPrefix %q", rawRunManifestPrefix)
+		}
+		if conf.pathPrefix == "" || strings.HasPrefix(conf.runManifestPrefix+"/", conf.listPrefix()) {
+			// listings of stored uploads skip it, see storedKey
+			log15.Warn("run_manifest_prefix_inside_path_prefix", "run_manifest_prefix", conf.runManifestPrefix, "path_prefix", conf.pathPrefix)
+		}
+	}
+
+	allowedCIDRs, err := kv.getOptional("allowedCIDRs")
+	if err != nil {
+		return nil, err
+	}
+	conf.allowedNets, err = parseCIDRs(allowedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	readOnly, err := kv.getOptional("readOnly")
+	if err != nil {
+		return nil, err
+	}
+	if readOnly != "" {
+		conf.readOnly, err = strconv.ParseBool(readOnly)
+		if err != nil {
+			return nil, fmt.Errorf("invalid readOnly %q, expected true or false", readOnly)
+		}
+	}
+
+	accelerate, err := kv.getOptional("accelerate")
+	if err != nil {
+		return nil, err
+	}
+	if accelerate != "" {
+		conf.accelerate, err = strconv.ParseBool(accelerate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid accelerate %q, expected true or false", accelerate)
+		}
+	}
+
+	maxUpload, err := kv.getOptional("maxUploadBytes")
+	if err != nil {
+		return nil, err
+	}
+	if maxUpload != "" {
+		conf.maxUploadBytes, err = parseSize(maxUpload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maxUploadBytes: %w", err)
+		}
+	}
+
+	typeMaxUploadJSON, err := kv.getOptional("typeMaxUploadBytes")
+	if err != nil {
+		return nil, err
+	}
+	conf.typeMaxUploadBytes, err = parseTypeMaxUploadBytes(typeMaxUploadJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	allowedAlbums, err := kv.getOptional("allowedAlbums")
+	if err != nil {
+		return nil, err
+	}
+	conf.allowedAlbums, err = parseAlbums(allowedAlbums)
+	if err != nil {
+		return nil, err
+	}
+
+	typePrefixesJSON, err := kv.getOptional("typePrefixes")
+	if err != nil {
+		return nil, err
+	}
+	conf.typePrefixes, err = parseTypePrefixes(typePrefixesJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.bcryptPass, err = kv.get("bcryptPass")
+	if err != nil {
+		return nil, err
+	}
+
+	cost, err := bcrypt.Cost([]byte(conf.bcryptPass))
+	if err != nil {
+		return nil, fmt.Errorf("bcryptPass is not a valid bcrypt hash: %w", err)
+	}
+	log15.Info("bcrypt_hash_loaded", "cost", cost)
+	if cost < *minBcryptCost {
+		log15.Warn("weak_bcrypt_cost", "cost", cost, "min_cost", *minBcryptCost)
+	}
+
+	return &conf, nil
+}
+
+// normalizePrefix cleans up a key prefix so it has no leading, trailing or
+// repeated slashes. "/" and "" both mean no prefix.
+func normalizePrefix(prefix string) string {
+	return strings.Trim(path.Clean("/"+prefix), "/")
+}
+
+// parseAlbums parses a comma separated list of album prefixes.
+func parseAlbums(raw string) ([]string, error) {
+	var albums []string
+	for _, album := range strings.Split(raw, ",") {
+		if strings.TrimSpace(album) == "" {
+			continue
+		}
+		norm := normalizePrefix(strings.TrimSpace(album))
+		if norm == "" {
+			return nil, fmt.Errorf("invalid album %q in allowedAlbums", album)
+		}
+		albums = append(albums, norm)
+	}
+	return albums, nil
+}
+
+// album returns the normalized form of a requested album if it is in
+// allowedAlbums.
+func (c *ssmConfig) album(requested string) (string, bool) {
+	norm := normalizePrefix(requested)
+	for _, album := range c.allowedAlbums {
+		if album == norm {
+			return album, true
+		}
+	}
+	return "", false
+}
+
+// parseCIDRs parses a comma separated list of CIDRs. A bare address is
+// treated as a single host network.
+func parseCIDRs(raw string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(raw, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid allowedCIDRs entry %q", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			cidr = fmt.Sprintf("%s/%d", cidr, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowedCIDRs entry %q: %w", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// parseTypePrefixes parses the typePrefixes JSON object, e.g.
+// {"image": "photos", "video": "videos"}.
+func parseTypePrefixes(raw string) (map[string]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var m map[string]string
+	err := json.Unmarshal([]byte(raw), &m)
+	if err != nil {
+		return nil, fmt.Errorf("parse typePrefixes err: %w", err)
+	}
+
+	prefixes := make(map[string]string, len(m))
+	for typ, prefix := range m {
+		typ = strings.ToLower(typ)
+		if typ == "" || strings.Contains(typ, "/") {
+			return nil, fmt.Errorf("typePrefixes: invalid type %q, expected a top-level type like image", typ)
+		}
+		prefix = normalizePrefix(prefix)
+		if prefix == "" || strings.Contains(prefix, "..") {
+			return nil, fmt.Errorf("typePrefixes: invalid prefix for %s", typ)
+		}
+		prefixes[typ] = prefix
+	}
+	return prefixes, nil
+}
+
+// parseTypeMaxUploadBytes parses the typeMaxUploadBytes JSON object, e.g.
+// {"image": "50MB", "video": "5GB", "audio": "200MB"}.
+func parseTypeMaxUploadBytes(raw string) (map[string]int64, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var m map[string]string
+	err := json.Unmarshal([]byte(raw), &m)
+	if err != nil {
+		return nil, fmt.Errorf("parse typeMaxUploadBytes err: %w", err)
+	}
+
+	limits := make(map[string]int64, len(m))
+	for typ, size := range m {
+		typ = strings.ToLower(typ)
+		if typ == "" || strings.Contains(typ, "/") {
+			return nil, fmt.Errorf("typeMaxUploadBytes: invalid type %q, expected a top-level type like image", typ)
+		}
+		limits[typ], err = parseSize(size)
+		if err != nil {
+			return nil, fmt.Errorf("typeMaxUploadBytes: invalid size for %s: %w", typ, err)
+		}
+	}
+	return limits, nil
+}
+
+// sizeUnits are the suffixes parseSize accepts, as powers of 1024.
+var sizeUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses a positive byte count with an optional KB, MB, GB or
+// TB suffix (powers of 1024), e.g. "50MB".
+func parseSize(raw string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(raw))
+	mult := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("invalid size %q, expected a byte count like 50MB", raw)
+	}
+	return n * mult, nil
+}
+
+// maxUploadFor returns the size limit for contentType and the top-level
+// type it came from, or "" for the maxUploadBytes default. A limit of 0
+// means no limit.
+func (c *ssmConfig) maxUploadFor(contentType string) (int64, string) {
+	typ := strings.ToLower(strings.SplitN(contentType, "/", 2)[0])
+	if limit, ok := c.typeMaxUploadBytes[typ]; ok {
+		return limit, typ
+	}
+	return c.maxUploadBytes, ""
+}
+
+// typePrefix returns prefix plus the sub-prefix for contentType's
+// top-level type, or just prefix if the type has none.
+func (c *ssmConfig) typePrefix(prefix, contentType string) string {
+	typ := strings.ToLower(strings.SplitN(contentType, "/", 2)[0])
+	if sub, ok := c.typePrefixes[typ]; ok {
+		return path.Join(prefix, sub)
+	}
+	return prefix
+}
+
+// untypeDir strips a type sub-prefix from the end of dir, as long as what
+// is left is still pathPrefix or under it.
+func (c *ssmConfig) untypeDir(dir string) string {
+	for _, sub := range c.typePrefixes {
+		var base string
+		switch {
+		case dir == sub:
+			base = "."
+		case strings.HasSuffix(dir, "/"+sub):
+			base = strings.TrimSuffix(dir, "/"+sub)
+		default:
+			continue
+		}
+		if c.pathPrefix == "" || base == c.pathPrefix || strings.HasPrefix(base, c.listPrefix()) {
+			return base
+		}
+	}
+	return dir
+}
+
+// listPrefix is the prefix used to list the objects under pathPrefix. It
+// ends in a slash so "photos" doesn't also match "photos2/".
+func (c *ssmConfig) listPrefix() string {
+	if c.pathPrefix == "" {
+		return ""
+	}
+	return c.pathPrefix + "/"
+}
+
+// storedKey reports whether a key listed under pathPrefix is a stored
+// upload. The inbox, marker and run manifest prefixes can sit inside
+// pathPrefix (they always do when pathPrefix is empty), and their objects
+// can carry the id of a file in their key without being that file, so
+// listings of stored uploads skip them.
+func (c *ssmConfig) storedKey(key string) bool {
+	for _, prefix := range []string{c.inboxPrefix, c.markerPrefix, c.runManifestPrefix} {
+		if prefix != "" && strings.HasPrefix(key, prefix+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTimeFormat validates a key timestamp layout, returning the default
+// layout if raw is empty. The layout must round trip a time to the second
+// and can't contain path separators.
+func parseTimeFormat(raw string) (string, error) {
+	if raw == "" {
+		return defaultTimeFormat, nil
+	}
+	if strings.Contains(raw, "/") {
+		return "", fmt.Errorf("invalid timeFormat %q: must not contain /", raw)
+	}
+
+	ref := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC)
+	parsed, err := time.Parse(raw, ref.Format(raw))
+	if err != nil {
+		return "", fmt.Errorf("invalid timeFormat %q: %w", raw, err)
+	}
+	if !parsed.Equal(ref) {
+		return "", fmt.Errorf("invalid timeFormat %q: must include the date and time to at least second precision", raw)
+	}
+	return raw, nil
+}
+
+func (s *server) config() *ssmConfig {
+	return s.conf.Load().(*ssmConfig)
+}
+
+// refreshSSMConfig periodically re-reads the config from SSM and swaps it
+// in. Each wait is jittered by up to 10% so multiple servers don't hit SSM
+// in lockstep.
+func (s *server) refreshSSMConfig(kv *kv, interval time.Duration) {
+	for {
+		jitter := time.Duration(rand.Int63n(int64(interval)/10 + 1))
+		time.Sleep(interval + jitter)
+
+		newConf, err := loadSSMConfig(kv)
+		if err == nil {
+			err = checkBuckets(s.s3, newConf)
+		}
+		if err != nil {
+			log15.Error("ssm_config_refresh_err", "err", err)
+			continue
+		}
+
+		oldConf := s.config()
+		logConfigChanges(oldConf, newConf)
+		s.conf.Store(newConf)
+	}
+}
+
+func logConfigChanges(oldConf, newConf *ssmConfig) {
+	if oldConf.bucket != newConf.bucket {
+		log15.Info("ssm_config_changed", "key", "bucket", "old", oldConf.bucket, "new", newConf.bucket)
+	}
+	if oldConf.pathPrefix != newConf.pathPrefix {
+		log15.Info("ssm_config_changed", "key", "pathPrefix", "old", oldConf.pathPrefix, "new", newConf.pathPrefix)
+	}
+	if !reflect.DeepEqual(oldConf.bucketRules, newConf.bucketRules) {
+		log15.Info("ssm_config_changed", "key", "bucketRules", "old", fmt.Sprint(oldConf.bucketRules), "new", fmt.Sprint(newConf.bucketRules))
+	}
+	if oldConf.objectLockMode != newConf.objectLockMode {
+		log15.Info("ssm_config_changed", "key", "objectLockMode", "old", oldConf.objectLockMode, "new", newConf.objectLockMode)
+	}
+	if oldConf.timeFormat != newConf.timeFormat {
+		log15.Info("ssm_config_changed", "key", "timeFormat", "old", oldConf.timeFormat, "new", newConf.timeFormat)
+	}
+	if oldConf.extensionCheck != newConf.extensionCheck {
+		log15.Info("ssm_config_changed", "key", "extensionCheck", "old", oldConf.extensionCheck, "new", newConf.extensionCheck)
+	}
+	if oldConf.idShardChars != newConf.idShardChars {
+		log15.Info("ssm_config_changed", "key", "idShardChars", "old", oldConf.idShardChars, "new", newConf.idShardChars)
+	}
+	if oldConf.markerPrefix != newConf.markerPrefix {
+		log15.Info("ssm_config_changed", "key", "markerPrefix", "old", oldConf.markerPrefix, "new", newConf.markerPrefix)
+	}
+	if oldConf.inboxPrefix != newConf.inboxPrefix {
+		log15.Info("ssm_config_changed", "key", "inboxPrefix", "old", oldConf.inboxPrefix, "new", newConf.inboxPrefix)
+	}
+	if oldConf.runManifestPrefix != newConf.runManifestPrefix {
+		log15.Info("ssm_config_changed", "key", "runManifestPrefix", "old", oldConf.runManifestPrefix, "new", newConf.runManifestPrefix)
+	}
+	if fmt.Sprint(oldConf.allowedNets) != fmt.Sprint(newConf.allowedNets) {
+		log15.Info("ssm_config_changed", "key", "allowedCIDRs", "old", fmt.Sprint(oldConf.allowedNets), "new", fmt.Sprint(newConf.allowedNets))
+	}
+	if oldConf.maxUploadBytes != newConf.maxUploadBytes {
+		log15.Info("ssm_config_changed", "key", "maxUploadBytes", "old", oldConf.maxUploadBytes, "new", newConf.maxUploadBytes)
+	}
+	if !reflect.DeepEqual(oldConf.typeMaxUploadBytes, newConf.typeMaxUploadBytes) {
+		log15.Info("ssm_config_changed", "key", "typeMaxUploadBytes", "old", fmt.Sprint(oldConf.typeMaxUploadBytes), "new", fmt.Sprint(newConf.typeMaxUploadBytes))
+	}
+	if oldConf.readOnly != newConf.readOnly {
+		log15.Info("ssm_config_changed", "key", "readOnly", "old", oldConf.readOnly, "new", newConf.readOnly)
+	}
+	if oldConf.accelerate != newConf.accelerate {
+		log15.Info("ssm_config_changed", "key", "accelerate", "old", oldConf.accelerate, "new", newConf.accelerate)
+	}
+	if !reflect.DeepEqual(oldConf.allowedAlbums, newConf.allowedAlbums) {
+		log15.Info("ssm_config_changed", "key", "allowedAlbums", "old", fmt.Sprint(oldConf.allowedAlbums), "new", fmt.Sprint(newConf.allowedAlbums))
+	}
+	if !reflect.DeepEqual(oldConf.typePrefixes, newConf.typePrefixes) {
+		log15.Info("ssm_config_changed", "key", "typePrefixes", "old", fmt.Sprint(oldConf.typePrefixes), "new", fmt.Sprint(newConf.typePrefixes))
+	}
+	if oldConf.bcryptPass != newConf.bcryptPass {
+		// never log the hash itself
+		log15.Info("ssm_config_changed", "key", "bcryptPass")
+	}
+}
+
+// ConfigResponse is the non-secret effective configuration returned by
+// GET /config. It must never include bcryptPass or any credentials.
+type ConfigResponse struct {
+	Bucket               string            `json:"bucket"`
+	BucketRules          []bucketRule      `json:"bucket_rules,omitempty"`
+	PathPrefix           string            `json:"path_prefix"`
+	ObjectLockMode       string            `json:"object_lock_mode,omitempty"`
+	TimeFormat           string            `json:"time_format"`
+	ExtensionCheck       string            `json:"extension_check"`
+	IDShardChars         int               `json:"id_shard_chars,omitempty"`
+	MarkerPrefix         string            `json:"marker_prefix,omitempty"`
+	InboxPrefix          string            `json:"inbox_prefix,omitempty"`
+	RunManifestPrefix    string            `json:"run_manifest_prefix,omitempty"`
+	AllowedCIDRs         []string          `json:"allowed_cidrs,omitempty"`
+	TypePrefixes         map[string]string `json:"type_prefixes,omitempty"`
+	AllowedAlbums        []string          `json:"allowed_albums,omitempty"`
+	MaxUploadBytes       int64             `json:"max_upload_bytes,omitempty"`
+	TypeMaxUploadBytes   map[string]int64  `json:"type_max_upload_bytes,omitempty"`
+	ReadOnly             bool              `json:"read_only,omitempty"`
+	Accelerate           bool              `json:"accelerate,omitempty"`
+	Region               string            `json:"region"`
+	PresignExpiry        string            `json:"presign_expiry"`
+	PresignMinBandwidth  int64             `json:"presign_min_bandwidth,omitempty"`
+	ClientCertAuthOnly   bool              `json:"client_cert_auth_only"`
+	ClientCertUserPrefix bool              `json:"client_cert_user_prefix"`
+}
+
+func (s *server) effectiveConfig() ConfigResponse {
+	conf := s.config()
+	var allowed []string
+	for _, n := range conf.allowedNets {
+		allowed = append(allowed, n.String())
+	}
+	return ConfigResponse{
+		Bucket:               conf.bucket,
+		BucketRules:          conf.bucketRules,
+		PathPrefix:           conf.pathPrefix,
+		ObjectLockMode:       conf.objectLockMode,
+		TimeFormat:           conf.timeFormat,
+		ExtensionCheck:       conf.extensionCheck,
+		IDShardChars:         conf.idShardChars,
+		MarkerPrefix:         conf.markerPrefix,
+		InboxPrefix:          conf.inboxPrefix,
+		RunManifestPrefix:    conf.runManifestPrefix,
+		AllowedCIDRs:         allowed,
+		TypePrefixes:         conf.typePrefixes,
+		AllowedAlbums:        conf.allowedAlbums,
+		MaxUploadBytes:       conf.maxUploadBytes,
+		TypeMaxUploadBytes:   conf.typeMaxUploadBytes,
+		ReadOnly:             conf.readOnly,
+		Accelerate:           conf.accelerate,
+		Region:               s.region,
+		PresignExpiry:        s.presignExpiry.String(),
+		PresignMinBandwidth:  s.presignMinBandwidth,
+		ClientCertAuthOnly:   s.certAuthOnly,
+		ClientCertUserPrefix: s.certUserPrefix,
+	}
+}
+
+// logStartupConfig logs the effective configuration once at startup as a
+// single line. The config value is the GET /config response, so it leaves
+// out bcryptPass the same way.
+func (s *server) logStartupConfig(mode string) {
+	confJSON, _ := json.Marshal(s.effectiveConfig())
+	log15.Info("startup_config", "mode", mode, "protocol_version", protocolVersion,
+		"ssm_refresh", *ssmRefresh, "id_filter_capacity", *idFilterCapacity, "config", string(confJSON))
+}
+
+func (s *server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.writeBadMethod(w)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(s.effectiveConfig())
+}
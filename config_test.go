@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizePrefix(t *testing.T) {
+	checks := []struct {
+		raw, want string
+	}{
+		{"", ""},
+		{"/", ""},
+		{"//", ""},
+		{".", ""},
+		{"photos", "photos"},
+		{"photos/", "photos"},
+		{"/photos", "photos"},
+		{"/photos/", "photos"},
+		{"photos//2021", "photos/2021"},
+		{"//photos//2021//", "photos/2021"},
+		{"photos/./2021", "photos/2021"},
+		{"../photos", "photos"},
+	}
+	for _, check := range checks {
+		got := normalizePrefix(check.raw)
+		if got != check.want {
+			t.Errorf("normalizePrefix(%q) = %q, want %q", check.raw, got, check.want)
+		}
+	}
+}
+
+func TestKeysWithNormalizedPrefix(t *testing.T) {
+	s := &server{}
+	meta := FileMetadata{
+		ID:    strings.Repeat("ab", 32),
+		Name:  "IMG_0001.jpg",
+		Mtime: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+	r := httptest.NewRequest("POST", "/upload_request", nil)
+
+	checks := []struct {
+		rawPrefix  string
+		wantKey    string
+		wantListed string
+	}{
+		{"", "2021-06-01-12_00_00-" + meta.ID + "-IMG_0001.jpg", ""},
+		{"/", "2021-06-01-12_00_00-" + meta.ID + "-IMG_0001.jpg", ""},
+		{"photos/", "photos/2021-06-01-12_00_00-" + meta.ID + "-IMG_0001.jpg", "photos/"},
+		{"/photos", "photos/2021-06-01-12_00_00-" + meta.ID + "-IMG_0001.jpg", "photos/"},
+		{"//photos//2021/", "photos/2021/2021-06-01-12_00_00-" + meta.ID + "-IMG_0001.jpg", "photos/2021/"},
+	}
+	for _, check := range checks {
+		conf := &ssmConfig{
+			pathPrefix: normalizePrefix(check.rawPrefix),
+			timeFormat: defaultTimeFormat,
+		}
+		prefix := s.keyPrefix(conf, r)
+		key, _ := s.objectKey(conf, prefix, meta, 0)
+		if key != check.wantKey {
+			t.Errorf("prefix %q: key = %q, want %q", check.rawPrefix, key, check.wantKey)
+		}
+		if !keyWithinPrefix(key, prefix) {
+			t.Errorf("prefix %q: key %q failed keyWithinPrefix(%q)", check.rawPrefix, key, prefix)
+		}
+		if listed := conf.listPrefix(); listed != check.wantListed {
+			t.Errorf("prefix %q: listPrefix = %q, want %q", check.rawPrefix, listed, check.wantListed)
+		}
+	}
+}
+
+func TestStoredKey(t *testing.T) {
+	conf := &ssmConfig{inboxPrefix: "inbox", markerPrefix: "markers", runManifestPrefix: "runs"}
+	checks := []struct {
+		key  string
+		want bool
+	}{
+		{"2021-06-01-12_00_00-id-a.jpg", true},
+		{"photos/a.jpg", true},
+		{"inboxes/a.jpg", true},
+		{"inbox/2021-06-01/2021-06-01-12_00_00-id-a.jpg", false},
+		{"markers/2021-06-01-12_00_00-id-a.jpg.json", false},
+		{"runs/laptop/2021-06-01.json", false},
+	}
+	for _, check := range checks {
+		if got := conf.storedKey(check.key); got != check.want {
+			t.Errorf("storedKey(%q) = %t, want %t", check.key, got, check.want)
+		}
+	}
+	if !(&ssmConfig{}).storedKey("inbox/a.jpg") {
+		t.Error("storedKey skipped a key with no inbox configured")
+	}
+}
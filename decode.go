@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	neturl "net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// decodeMetadata decodes a FileMetadata request body, rejecting unknown
+// fields. Bodies are JSON unless contentType is
+// application/x-www-form-urlencoded. On failure the returned error
+// describes which field was bad in terms suitable for returning to the
+// client.
+func decodeMetadata(contentType string, r io.Reader) (FileMetadata, error) {
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/x-www-form-urlencoded" {
+		return decodeFormMetadata(r)
+	}
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	var meta FileMetadata
+	err := dec.Decode(&meta)
+	if err != nil {
+		return meta, describeDecodeErr(err)
+	}
+	return meta, nil
+}
+
+// decodeFormMetadata decodes a form encoded FileMetadata. Fields use the
+// same names as the JSON body, looked up from its json tags; extra
+// metadata is sent as extra.<key>.
+func decodeFormMetadata(r io.Reader) (FileMetadata, error) {
+	var meta FileMetadata
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return meta, describeDecodeErr(err)
+	}
+	if len(body) == 0 {
+		return meta, errors.New("empty request body")
+	}
+	form, err := neturl.ParseQuery(string(body))
+	if err != nil {
+		return meta, errors.New("malformed form body")
+	}
+
+	fields := formFields()
+	v := reflect.ValueOf(&meta).Elem()
+	for field, values := range form {
+		if len(values) != 1 {
+			return meta, fmt.Errorf("field %q given more than once", field)
+		}
+		val := values[0]
+
+		if key := strings.TrimPrefix(field, "extra."); key != field {
+			if meta.Extra == nil {
+				meta.Extra = make(map[string]string)
+			}
+			meta.Extra[key] = val
+			continue
+		}
+
+		i, ok := fields[field]
+		if !ok {
+			return meta, fmt.Errorf("unknown field %q", field)
+		}
+		fv := v.Field(i)
+		switch fv.Interface().(type) {
+		case string:
+			fv.SetString(val)
+		case bool:
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return meta, fmt.Errorf("invalid value for field %q: expected bool, got %s", field, val)
+			}
+			fv.SetBool(b)
+		case int, int64:
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return meta, fmt.Errorf("invalid value for field %q: expected %s, got %s", field, fv.Type(), val)
+			}
+			fv.SetInt(n)
+		case time.Time:
+			t, err := time.Parse(time.RFC3339Nano, val)
+			if err != nil {
+				return meta, fmt.Errorf("invalid value for field %q: expected RFC3339 timestamp", field)
+			}
+			fv.Set(reflect.ValueOf(t))
+		default:
+			return meta, fmt.Errorf("field %q can't be form encoded", field)
+		}
+	}
+	return meta, nil
+}
+
+// formFields maps the JSON name of each FileMetadata field to its index,
+// so form bodies accept exactly the fields the JSON body does.
+func formFields() map[string]int {
+	t := reflect.TypeOf(FileMetadata{})
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = i
+		}
+	}
+	return fields
+}
+
+// errBodyTooLarge is returned when the request body exceeds the limit set
+// with http.MaxBytesReader.
+var errBodyTooLarge = errors.New("request body too large")
+
+func describeDecodeErr(err error) error {
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+		timeErr   *time.ParseError
+	)
+
+	switch {
+	case err.Error() == "http: request body too large":
+		return errBodyTooLarge
+	case errors.Is(err, io.EOF):
+		return errors.New("empty request body")
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("malformed json at offset %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		return fmt.Errorf("invalid value for field %q: expected %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	case errors.As(err, &timeErr):
+		return fmt.Errorf("invalid value for field %q: expected RFC3339 timestamp", "mtime")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return fmt.Errorf("unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+	return errors.New("malformed json")
+}
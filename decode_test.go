@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeFormMetadata(t *testing.T) {
+	form := strings.Join([]string{
+		"id=0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		"name=IMG_0001.jpg",
+		"mtime=2021-06-01T12:00:00Z",
+		"size=1234",
+		"content_type=image%2Fjpeg",
+		"test_upload=true",
+		"device=laptop",
+		"validate_only=true",
+		"extra.camera=x100",
+		"expire_after=720h",
+		"thumbnail_of=photos%2Fa.jpg",
+		"perceptual_hash=00ff00ff00ff00ff",
+		"album=trips",
+		"version=1",
+		"method=POST",
+	}, "&")
+
+	got, err := decodeMetadata("application/x-www-form-urlencoded", strings.NewReader(form))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := FileMetadata{
+		ID:             "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		Name:           "IMG_0001.jpg",
+		Mtime:          time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+		Bytes:          1234,
+		ContentType:    "image/jpeg",
+		TestUpload:     true,
+		Device:         "laptop",
+		ValidateOnly:   true,
+		Extra:          map[string]string{"camera": "x100"},
+		ExpireAfter:    "720h",
+		ThumbnailOf:    "photos/a.jpg",
+		PerceptualHash: "00ff00ff00ff00ff",
+		Album:          "trips",
+		Version:        1,
+		Method:         "POST",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	// every field must be settable, so a new FileMetadata field without
+	// a value here fails the test
+	v := reflect.ValueOf(got)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() {
+			t.Errorf("field %s not set by the form", v.Type().Field(i).Name)
+		}
+	}
+}
+
+func TestDecodeFormMetadataErrors(t *testing.T) {
+	tests := []struct {
+		form string
+		want string
+	}{
+		{"", "empty request body"},
+		{"size=big", `invalid value for field "size": expected int64, got big`},
+		{"version=two", `invalid value for field "version": expected int, got two`},
+		{"mtime=yesterday", `invalid value for field "mtime": expected RFC3339 timestamp`},
+		{"test_upload=maybe", `invalid value for field "test_upload": expected bool, got maybe`},
+		{"nmae=a.jpg", `unknown field "nmae"`},
+		{"name=a.jpg&name=b.jpg", `field "name" given more than once`},
+		{"extra=x", `field "extra" can't be form encoded`},
+	}
+	for _, tc := range tests {
+		_, err := decodeMetadata("application/x-www-form-urlencoded; charset=utf-8", strings.NewReader(tc.form))
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("decode %q: err = %v, want %q", tc.form, err, tc.want)
+		}
+	}
+}
+
+func TestDecodeMetadataErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"empty", ``, "empty request body"},
+		{"syntax", `{"id": "abc",}`, "malformed json at offset 14"},
+		{"truncated", `{"id": "abc"`, "malformed json"},
+		{"size not a number", `{"size": "big"}`, `invalid value for field "size": expected int64, got string`},
+		{"size overflow", `{"size": 1e40}`, `invalid value for field "size": expected int64, got number 1e40`},
+		{"test_upload not bool", `{"test_upload": "yes"}`, `invalid value for field "test_upload": expected bool, got string`},
+		{"malformed mtime", `{"mtime": "last tuesday"}`, `invalid value for field "mtime": expected RFC3339 timestamp`},
+		{"mtime wrong type", `{"mtime": 12345}`, `invalid value for field "mtime": expected time.Time, got number`},
+		{"unknown field", `{"nmae": "a.jpg"}`, `unknown field "nmae"`},
+		{"extra not an object", `{"extra": "x"}`, `invalid value for field "extra": expected map[string]string, got string`},
+	}
+	for _, tc := range tests {
+		_, err := decodeMetadata("application/json", strings.NewReader(tc.body))
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("%s: err = %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestDecodeMetadataBodyTooLarge(t *testing.T) {
+	w := httptest.NewRecorder()
+	body := http.MaxBytesReader(w, io.NopCloser(strings.NewReader(`{"name": "`+strings.Repeat("a", 100)+`"}`)), 10)
+	_, err := decodeMetadata("application/json", body)
+	if err != errBodyTooLarge {
+		t.Errorf("err = %v, want errBodyTooLarge", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/inconshreveable/log15"
+)
+
+const (
+	// maxDownloadBatch is the most keys one /download_batch request can
+	// ask for.
+	maxDownloadBatch = 1000
+
+	// downloadExpiry is how long download URLs stay valid, long enough
+	// for a client to work through a whole batch.
+	downloadExpiry = 1 * time.Hour
+)
+
+type DownloadBatchRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type DownloadURL struct {
+	Key string `json:"key"`
+	URL string `json:"url"`
+}
+
+type DownloadBatchResponse struct {
+	Status    string        `json:"status"`
+	URLs      []DownloadURL `json:"urls"`
+	ExpiresAt time.Time     `json:"expires_at"`
+}
+
+// handleDownloadBatch returns presigned GETs for a list of keys in the
+// default bucket, for restoring many files in parallel. Every key must be
+// under the caller's prefix or the whole request is rejected.
+func (s *server) handleDownloadBatch(w http.ResponseWriter, r *http.Request) {
+	lgr := LgrFromContext(r.Context())
+
+	if r.Method != "POST" {
+		s.writeBadMethod(w)
+		return
+	}
+
+	var req DownloadBatchRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxDownloadBatch*(maxKeyBytes+8))).Decode(&req)
+	if err != nil {
+		lgr.Error("decode json err", "err", err)
+		s.writeError(w, http.StatusBadRequest, errCodeBadRequest, "bad request: "+err.Error())
+		return
+	}
+	lgr = lgr.New("keys", len(req.Keys))
+
+	if len(req.Keys) == 0 || len(req.Keys) > maxDownloadBatch {
+		lgr.Error("invalid_download_batch_size")
+		s.writeError(w, http.StatusBadRequest, errCodeBadRequest, "bad request: keys must have between 1 and "+strconv.Itoa(maxDownloadBatch)+" entries")
+		return
+	}
+
+	conf := s.config()
+	prefix := s.keyPrefix(conf, r)
+	for _, key := range req.Keys {
+		if key == "" || len(key) > maxKeyBytes || !keyWithinPrefix(key, prefix) {
+			lgr.Error("download_key_outside_prefix", "key", key, "prefix", prefix)
+			s.writeError(w, http.StatusForbidden, errCodeForbidden, "key outside allowed prefix: "+key)
+			return
+		}
+	}
+
+	resp := DownloadBatchResponse{
+		Status:    StatusOK,
+		URLs:      make([]DownloadURL, 0, len(req.Keys)),
+		ExpiresAt: s.clock.Now().Add(downloadExpiry),
+	}
+	for _, key := range req.Keys {
+		url, err := s.presignGet(lgr, &s3.GetObjectInput{
+			Bucket: aws.String(conf.bucket),
+			Key:    aws.String(key),
+		}, downloadExpiry)
+		if err != nil {
+			lgr.Error("presign_err", "key", key, "err", err)
+			s.writeError(w, http.StatusInternalServerError, errCodePresignFailed, "failed to presign download")
+			return
+		}
+		resp.URLs = append(resp.URLs, DownloadURL{Key: key, URL: url})
+	}
+
+	lgr.Info("download_batch_success")
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// presignGet presigns a GetObject request.
+func (s *server) presignGet(lgr log15.Logger, input *s3.GetObjectInput, expiry time.Duration) (string, error) {
+	return s.presign(lgr, expiry, func() *request.Request {
+		req, _ := s.presignClient().GetObjectRequest(input)
+		return req
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
+// Error codes returned in the error_code field of error responses.
+const (
+	errCodeBadRequest       = "bad_request"
+	errCodeInvalidID        = "invalid_id"
+	errCodeInvalidName      = "invalid_name"
+	errCodeUnauthorized     = "unauthorized"
+	errCodeForbidden        = "forbidden"
+	errCodeBadMethod        = "method_not_allowed"
+	errCodeNotFound         = "not_found"
+	errCodeTooLarge         = "request_too_large"
+	errCodeKeyCollisions    = "too_many_key_collisions"
+	errCodePresignFailed    = "presign_failed"
+	errCodeOriginalNotFound = "original_not_found"
+	errCodeMetadataTooLarge = "metadata_too_large"
+	errCodeTypeMismatch     = "extension_type_mismatch"
+	errCodeBucketNotFound   = "bucket_not_found"
+	errCodeReadOnly         = "read_only"
+	errCodeSizeLimit        = "size_limit_exceeded"
+	errCodeTypeSizeLimit    = "type_size_limit_exceeded"
+	errCodeAlbumNotAllowed  = "album_not_allowed"
+	errCodeBadVersion       = "unsupported_protocol_version"
+	errCodeInternal         = "internal_error"
+)
+
+// ErrorResponse is the body of every non-2xx, non-409 response.
+type ErrorResponse struct {
+	Status    string `json:"status"`
+	ErrorCode string `json:"error_code"`
+	Error     string `json:"error"`
+	Decision  string `json:"decision,omitempty"` // validate_only requests
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeError writes a JSON ErrorResponse with the given status code.
+func (s *server) writeError(w http.ResponseWriter, statusCode int, code, msg string) {
+	s.writeErrorResponse(w, statusCode, ErrorResponse{
+		Status:    StatusErr,
+		ErrorCode: code,
+		Error:     msg,
+	})
+}
+
+// rejectUpload writes the error response for an upload request that
+// failed validation. validate_only requests also get the would-reject
+// decision.
+func (s *server) rejectUpload(w http.ResponseWriter, meta FileMetadata, statusCode int, code, msg string) {
+	s.writeErrorResponse(w, statusCode, ErrorResponse{
+		Status:    StatusErr,
+		ErrorCode: code,
+		Error:     msg,
+		Decision:  validateDecision(meta, DecisionWouldReject),
+	})
+}
+
+func (s *server) writeErrorResponse(w http.ResponseWriter, statusCode int, resp ErrorResponse) {
+	s.stats.recordError(resp.ErrorCode)
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *server) writeBadMethod(w http.ResponseWriter) {
+	s.writeError(w, http.StatusMethodNotAllowed, errCodeBadMethod, "Bad Method")
+}
+
+func (s *server) handleNotFound(w http.ResponseWriter, r *http.Request) {
+	s.writeError(w, http.StatusNotFound, errCodeNotFound, "not found")
+}
+
+// readOnlyRetryAfter is the Retry-After sent while the server is read
+// only.
+const readOnlyRetryAfter = 5 * time.Minute
+
+// rejectReadOnly writes the 503 for a write request made while the server
+// is in a read-only maintenance window. It reports whether it did.
+func (s *server) rejectReadOnly(w http.ResponseWriter, lgr log15.Logger, conf *ssmConfig) bool {
+	if !conf.readOnly {
+		return false
+	}
+	lgr.Warn("read_only_reject")
+	w.Header().Set("retry-after", strconv.Itoa(int(readOnlyRetryAfter.Seconds())))
+	s.writeError(w, http.StatusServiceUnavailable, errCodeReadOnly, "maintenance in progress: the server is not accepting uploads, retry later")
+	return true
+}
+
+// rejectMissingBucket rejects an upload because its bucket doesn't exist,
+// which is a server misconfiguration rather than a problem with the file.
+func (s *server) rejectMissingBucket(w http.ResponseWriter, lgr log15.Logger, meta FileMetadata, bucket string, err error) {
+	lgr.Error("no_such_bucket", "err", err)
+	s.rejectUpload(w, meta, http.StatusInternalServerError, errCodeBucketNotFound, fmt.Sprintf("configured bucket %s does not exist", bucket))
+}
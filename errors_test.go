@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestErrorResponses(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{stats: newServerStats(time.Now())}
+	s.conf.Store(&ssmConfig{bcryptPass: string(hash)})
+
+	mux := s.routes()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	handler := s.logMiddleware(s.recoverMiddleware(s.basicAuthMiddleware(mux)))
+
+	checks := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		password string
+		status   int
+		code     string
+	}{
+		{"no auth", "POST", "/upload_request", "{}", "", http.StatusUnauthorized, errCodeUnauthorized},
+		{"wrong password", "POST", "/upload_request", "{}", "wrong", http.StatusUnauthorized, errCodeUnauthorized},
+		{"bad method", "GET", "/upload_request", "", "hunter2", http.StatusMethodNotAllowed, errCodeBadMethod},
+		{"not found", "GET", "/nope", "", "hunter2", http.StatusNotFound, errCodeNotFound},
+		{"too large", "POST", "/upload_request", `{"name": "` + strings.Repeat("a", maxMetadataBytes) + `"}`, "hunter2", http.StatusRequestEntityTooLarge, errCodeTooLarge},
+		{"malformed json", "POST", "/upload_request", `{"name": `, "hunter2", http.StatusBadRequest, errCodeBadRequest},
+		{"panic", "GET", "/panic", "", "hunter2", http.StatusInternalServerError, errCodeInternal},
+	}
+
+	for _, check := range checks {
+		t.Run(check.name, func(t *testing.T) {
+			r := httptest.NewRequest(check.method, check.path, strings.NewReader(check.body))
+			if check.password != "" {
+				r.SetBasicAuth("user", check.password)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != check.status {
+				t.Errorf("status = %d, want %d", w.Code, check.status)
+			}
+			if ct := w.Header().Get("content-type"); ct != "application/json" {
+				t.Errorf("content-type = %q", ct)
+			}
+			var resp ErrorResponse
+			err := json.Unmarshal(w.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatalf("body %q is not json: %s", w.Body.String(), err)
+			}
+			if resp.Status != StatusErr || resp.ErrorCode != check.code || resp.Error == "" {
+				t.Errorf("body = %+v, want status %q error_code %q and an error", resp, StatusErr, check.code)
+			}
+		})
+	}
+}
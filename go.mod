@@ -10,6 +10,8 @@ require (
 	github.com/inconshreveable/log15 v0.0.0-20201112154412-8562bdadbbac
 	github.com/mattn/go-colorable v0.1.8 // indirect
 	github.com/psanford/lambdahttp v0.0.0-20200502234822-43732589721d
+	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
 	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
-	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b
+	golang.org/x/sys v0.0.0-20200930185726-fdedc70b468f
+	golang.org/x/term v0.0.0-20201117132131-f5c789dd3221
 )
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/inconshreveable/log15"
+)
+
+// idFilterFPRate is the target false positive rate of the known id filter.
+const idFilterFPRate = 0.01
+
+// idFilter is a Bloom filter of the file ids already stored in s3. A miss
+// means the id is definitely not stored (as of the last refresh plus any ids
+// presigned since), so the HeadObject/ListObjects checks can be skipped. A
+// hit only means the id may be stored.
+type idFilter struct {
+	mu   sync.RWMutex
+	bits []uint64
+	k    uint64
+}
+
+func newIDFilter(capacity int) *idFilter {
+	n := float64(capacity)
+	m := math.Ceil(-n * math.Log(idFilterFPRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/n*math.Ln2))
+	return &idFilter{
+		bits: make([]uint64, (uint64(m)+63)/64),
+		k:    uint64(k),
+	}
+}
+
+// idHashes derives the two base hashes used for double hashing from the
+// id. Ids are hex sha256 sums, so their bytes are already uniformly
+// distributed.
+func idHashes(id string) (uint64, uint64, bool) {
+	sum, err := hex.DecodeString(id)
+	if err != nil || len(sum) < 16 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:16]) | 1, true
+}
+
+func (f *idFilter) add(id string) {
+	h1, h2, ok := idHashes(id)
+	if !ok {
+		return
+	}
+	nbits := uint64(len(f.bits)) * 64
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % nbits
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (f *idFilter) mayContain(id string) bool {
+	h1, h2, ok := idHashes(id)
+	if !ok {
+		return true
+	}
+	nbits := uint64(len(f.bits)) * 64
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % nbits
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// knownIDFilter returns the current id filter, or nil if it is disabled or
+// hasn't been loaded yet.
+func (s *server) knownIDFilter() *idFilter {
+	f, _ := s.idFilter.Load().(*idFilter)
+	return f
+}
+
+// loadIDFilter builds a new id filter from every object under pathPrefix
+// in all configured buckets.
+func (s *server) loadIDFilter(capacity int) (*idFilter, error) {
+	conf := s.config()
+	f := newIDFilter(capacity)
+
+	var count int
+	for _, bucket := range conf.allBuckets() {
+		err := s.s3.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(conf.listPrefix()),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				if !conf.storedKey(aws.StringValue(obj.Key)) {
+					continue
+				}
+				if id := idFromKey(aws.StringValue(obj.Key)); id != "" {
+					f.add(id)
+					count++
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if count > capacity {
+		log15.Warn("id_filter_over_capacity", "ids", count, "capacity", capacity)
+	}
+	log15.Info("id_filter_loaded", "ids", count, "capacity", capacity, "bytes", len(f.bits)*8)
+	return f, nil
+}
+
+// addKnownID records a presigned id in the current filter, and in the
+// side log of a rebuild in progress so the rebuilt filter keeps it.
+func (s *server) addKnownID(id string) {
+	s.idFilterMu.Lock()
+	defer s.idFilterMu.Unlock()
+	if f := s.knownIDFilter(); f != nil {
+		f.add(id)
+	}
+	if s.rebuildingFilter {
+		s.idsDuringRebuild = append(s.idsDuringRebuild, id)
+	}
+}
+
+func (s *server) startIDFilterRebuild() {
+	s.idFilterMu.Lock()
+	defer s.idFilterMu.Unlock()
+	s.rebuildingFilter = true
+	s.idsDuringRebuild = nil
+}
+
+// finishIDFilterRebuild merges the ids presigned during the rebuild into f
+// and swaps it in. A nil f (a failed rebuild) keeps the current filter.
+func (s *server) finishIDFilterRebuild(f *idFilter) {
+	s.idFilterMu.Lock()
+	defer s.idFilterMu.Unlock()
+	if f != nil {
+		for _, id := range s.idsDuringRebuild {
+			f.add(id)
+		}
+		s.idFilter.Store(f)
+	}
+	s.rebuildingFilter = false
+	s.idsDuringRebuild = nil
+}
+
+// refreshIDFilter loads the id filter and then rebuilds it every interval
+// (0 loads it once). On error the previous filter, if any, stays in use.
+func (s *server) refreshIDFilter(capacity int, interval time.Duration) {
+	for {
+		s.startIDFilterRebuild()
+		f, err := s.loadIDFilter(capacity)
+		if err != nil {
+			log15.Error("id_filter_load_err", "err", err)
+		}
+		s.finishIDFilterRebuild(f)
+
+		if interval <= 0 {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func testID(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestIDFilterRebuildKeepsAddedIDs(t *testing.T) {
+	s := &server{}
+	old := newIDFilter(100)
+	old.add(testID("listed"))
+	s.idFilter.Store(old)
+
+	s.startIDFilterRebuild()
+	// the rebuild's listing has already passed these ids' keys
+	rebuilt := newIDFilter(100)
+	rebuilt.add(testID("listed"))
+	s.addKnownID(testID("during"))
+	s.finishIDFilterRebuild(rebuilt)
+	s.addKnownID(testID("after"))
+
+	f := s.knownIDFilter()
+	if f != rebuilt {
+		t.Fatal("rebuilt filter wasn't swapped in")
+	}
+	for _, name := range []string{"listed", "during", "after"} {
+		if !f.mayContain(testID(name)) {
+			t.Errorf("filter lost the %s id", name)
+		}
+	}
+	if len(s.idsDuringRebuild) != 0 {
+		t.Errorf("side log still has %d ids after the rebuild", len(s.idsDuringRebuild))
+	}
+}
+
+func TestIDFilterFailedRebuild(t *testing.T) {
+	s := &server{}
+	old := newIDFilter(100)
+	s.idFilter.Store(old)
+
+	s.startIDFilterRebuild()
+	s.addKnownID(testID("during"))
+	s.finishIDFilterRebuild(nil)
+
+	f := s.knownIDFilter()
+	if f != old {
+		t.Fatal("failed rebuild replaced the filter")
+	}
+	if !f.mayContain(testID("during")) {
+		t.Error("filter lost an id added during the failed rebuild")
+	}
+}
+
+func TestIDFilterFirstLoad(t *testing.T) {
+	s := &server{}
+
+	s.startIDFilterRebuild()
+	s.addKnownID(testID("during"))
+	loaded := newIDFilter(100)
+	s.finishIDFilterRebuild(loaded)
+
+	if f := s.knownIDFilter(); f == nil || !f.mayContain(testID("during")) {
+		t.Error("first loaded filter is missing an id presigned while it loaded")
+	}
+}
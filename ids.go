@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// idFromKey extracts the file id from an object key, or returns "" if the
+// key isn't in the expected format.
+func idFromKey(key string) string {
+	// <timestamp>-id-name. The timestamp layout is configurable so the id
+	// is found as the first hyphen separated part that is a hex sha256.
+	fname := path.Base(key)
+	for _, part := range strings.Split(fname, "-") {
+		if isHexID(part) {
+			return part
+		}
+	}
+	return ""
+}
+
+func isHexID(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// packObjectName is the name the batch tool uploads a tar pack of small
+// files as (-pack-max-file-size). The files in a pack have no object of
+// their own, so their ids are only in the pack's manifest.
+const packObjectName = "pack.tar"
+
+// isPackKey reports whether key is a pack stored under id.
+func isPackKey(key, id string) bool {
+	base := path.Base(key)
+	i := strings.Index(base, "-"+id+"-")
+	if i < 0 {
+		return false
+	}
+	name := base[i+len(id)+2:]
+	if name == packObjectName {
+		return true
+	}
+	// a key collision suffix, pack-<seq>.tar
+	if !strings.HasPrefix(name, "pack-") || !strings.HasSuffix(name, ".tar") {
+		return false
+	}
+	seq := strings.TrimSuffix(strings.TrimPrefix(name, "pack-"), ".tar")
+	_, err := strconv.Atoi(seq)
+	return err == nil && seq[0] >= '0' && seq[0] <= '9'
+}
+
+// IDsResponse is a page of known file ids returned by GET /ids. Packs are
+// the keys of the page's tar packs, whose files' ids clients read from
+// the pack manifest.
+type IDsResponse struct {
+	IDs       []string `json:"ids"`
+	Packs     []string `json:"packs,omitempty"`
+	NextToken string   `json:"next_token,omitempty"`
+}
+
+// handleIDs returns the ids of the objects stored under the caller's
+// prefix in every configured bucket, one page at a time. Pass next_token
+// back as the token query parameter to fetch the next page.
+func (s *server) handleIDs(w http.ResponseWriter, r *http.Request) {
+	lgr := LgrFromContext(r.Context())
+
+	if r.Method != "GET" {
+		s.writeBadMethod(w)
+		return
+	}
+
+	conf := s.config()
+	prefix := s.keyPrefix(conf, r)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	buckets := conf.allBuckets()
+	bucketIdx, s3Token, err := parseIDsToken(r.URL.Query().Get("token"))
+	if err != nil || bucketIdx >= len(buckets) {
+		lgr.Error("invalid_ids_token", "err", err)
+		s.writeError(w, http.StatusBadRequest, errCodeBadRequest, "bad request: invalid token")
+		return
+	}
+	bucket := buckets[bucketIdx]
+
+	input := &s3.ListObjectsV2Input{
+		Bucket:  &bucket,
+		Prefix:  &prefix,
+		MaxKeys: aws.Int64(1000),
+	}
+	if s3Token != "" {
+		input.ContinuationToken = &s3Token
+	}
+
+	out, err := s.s3.ListObjectsV2(input)
+	if err != nil {
+		lgr.Error("list_ids_err", "bucket", bucket, "err", err)
+		s.writeError(w, http.StatusInternalServerError, errCodeInternal, "Internal Server Error")
+		return
+	}
+
+	resp := IDsResponse{
+		IDs: make([]string, 0, len(out.Contents)),
+	}
+	for _, obj := range out.Contents {
+		if !conf.storedKey(*obj.Key) {
+			continue
+		}
+		if id := idFromKey(*obj.Key); id != "" {
+			resp.IDs = append(resp.IDs, id)
+			if isPackKey(*obj.Key, id) {
+				resp.Packs = append(resp.Packs, *obj.Key)
+			}
+		}
+	}
+	if aws.BoolValue(out.IsTruncated) {
+		resp.NextToken = idsToken(bucketIdx, aws.StringValue(out.NextContinuationToken))
+	} else if bucketIdx+1 < len(buckets) {
+		resp.NextToken = idsToken(bucketIdx+1, "")
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// idsToken is the next_token of an /ids page: the index of the bucket
+// being listed in allBuckets and the s3 continuation token within it.
+func idsToken(bucketIdx int, s3Token string) string {
+	return strconv.Itoa(bucketIdx) + ":" + s3Token
+}
+
+// parseIDsToken parses an idsToken. An empty token starts at the first
+// bucket.
+func parseIDsToken(token string) (int, string, error) {
+	if token == "" {
+		return 0, "", nil
+	}
+	i := strings.Index(token, ":")
+	if i < 0 {
+		return 0, "", fmt.Errorf("token has no bucket index")
+	}
+	idx, err := strconv.Atoi(token[:i])
+	if err != nil || idx < 0 {
+		return 0, "", fmt.Errorf("invalid bucket index %q", token[:i])
+	}
+	return idx, token[i+1:], nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestIsPackKey(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"photos/2021-06-01-12_00_00-" + id + "-pack.tar", true},
+		{"photos/ab/2021-06-01-12_00_00-" + id + "-pack-2.tar", true},
+		{"photos/2021-06-01-12_00_00-" + id + "-pack.tar.gz", false},
+		{"photos/2021-06-01-12_00_00-" + id + "-pack-.tar", false},
+		{"photos/2021-06-01-12_00_00-" + id + "-pack--1.tar", false},
+		{"photos/2021-06-01-12_00_00-" + id + "-backpack.tar", false},
+		{"photos/2021-06-01-12_00_00-" + id + "-IMG_0001.jpg", false},
+		{"photos/pack.tar", false},
+	}
+	for _, tc := range tests {
+		if got := isPackKey(tc.key, id); got != tc.want {
+			t.Errorf("isPackKey(%q) = %v, want %v", tc.key, got, tc.want)
+		}
+	}
+}
+
+// fakeListS3 serves ListObjectsV2 for buckets of keys, one key per page.
+func fakeListS3(t *testing.T, buckets map[string][]string) *s3.S3 {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys, ok := buckets[strings.Trim(r.URL.Path, "/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchBucket</Code></Error>`)
+			return
+		}
+		var matching []string
+		for _, key := range keys {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				matching = append(matching, key)
+			}
+		}
+		start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+		fmt.Fprint(w, `<ListBucketResult>`)
+		if start < len(matching) {
+			fmt.Fprintf(w, `<Contents><Key>%s</Key></Contents>`, matching[start])
+		}
+		if start+1 < len(matching) {
+			fmt.Fprintf(w, `<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>`, start+1)
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	}))
+	t.Cleanup(ts.Close)
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(ts.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	return s3.New(sess)
+}
+
+func TestHandleIDsAllBuckets(t *testing.T) {
+	key := func(prefix, id, name string) string {
+		return prefix + "2021-06-01-12_00_00-" + id + "-" + name
+	}
+	s := &server{
+		stats: newServerStats(time.Now()),
+		s3: fakeListS3(t, map[string][]string{
+			"default": {key("photos/", testID("a"), "a.jpg"), key("photos/", testID("b"), "b.jpg"), key("other/", testID("x"), "x.jpg")},
+			"videos":  {key("photos/", testID("c"), "c.mov")},
+			"empty":   nil,
+			"packs":   {key("photos/", testID("d"), "pack.tar")},
+		}),
+	}
+	s.conf.Store(&ssmConfig{
+		bucket:     "default",
+		pathPrefix: "photos",
+		bucketRules: []bucketRule{
+			{Bucket: "videos", ContentTypePrefix: "video/"},
+			{Bucket: "empty", MinBytes: 1 << 30},
+			{Bucket: "packs", ContentTypePrefix: "application/x-tar"},
+		},
+	})
+
+	var (
+		ids   []string
+		packs []string
+		token string
+	)
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("pagination didn't end")
+		}
+		r := httptest.NewRequest("GET", "/ids?token="+url.QueryEscape(token), nil)
+		w := httptest.NewRecorder()
+		s.handleIDs(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body.String())
+		}
+		var resp IDsResponse
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, resp.IDs...)
+		packs = append(packs, resp.Packs...)
+		if resp.NextToken == "" {
+			break
+		}
+		token = resp.NextToken
+	}
+
+	want := []string{testID("a"), testID("b"), testID("c"), testID("d")}
+	sort.Strings(ids)
+	sort.Strings(want)
+	if strings.Join(ids, ",") != strings.Join(want, ",") {
+		t.Errorf("ids = %v, want %v", ids, want)
+	}
+	if len(packs) != 1 || packs[0] != key("photos/", testID("d"), "pack.tar") {
+		t.Errorf("packs = %v", packs)
+	}
+}
+
+func TestHandleIDsBadToken(t *testing.T) {
+	s := &server{stats: newServerStats(time.Now())}
+	s.conf.Store(&ssmConfig{bucket: "default"})
+
+	for _, token := range []string{"nocolon", "x:abc", "-1:abc", "1:abc"} {
+		r := httptest.NewRequest("GET", "/ids?token="+url.QueryEscape(token), nil)
+		w := httptest.NewRecorder()
+		s.handleIDs(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("token %q: status = %d, want 400", token, w.Code)
+		}
+	}
+}
+
+func TestHandleIDsSkipsInbox(t *testing.T) {
+	stored := "2021-06-01-12_00_00-" + testID("stored") + "-a.jpg"
+	staged := "inbox/2021-06-01/2021-06-01-12_00_00-" + testID("staged") + "-b.jpg"
+	s := &server{
+		stats: newServerStats(time.Now()),
+		s3:    fakeListS3(t, map[string][]string{"default": {staged, stored}}),
+	}
+	s.conf.Store(&ssmConfig{bucket: "default", inboxPrefix: "inbox"})
+
+	var ids []string
+	token := ""
+	for {
+		w := httptest.NewRecorder()
+		s.handleIDs(w, httptest.NewRequest("GET", "/ids?token="+url.QueryEscape(token), nil))
+		var resp IDsResponse
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, resp.IDs...)
+		if resp.NextToken == "" {
+			break
+		}
+		token = resp.NextToken
+	}
+	if len(ids) != 1 || ids[0] != testID("stored") {
+		t.Errorf("ids = %v, want only the stored upload's id", ids)
+	}
+}
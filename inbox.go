@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/inconshreveable/log15"
+)
+
+// inboxDateFormat is the layout of the dated directory under inboxPrefix.
+const inboxDateFormat = "2006-01-02"
+
+// inboxKey returns the staging key for an upload to key started at t.
+func (c *ssmConfig) inboxKey(t time.Time, key string) string {
+	return path.Join(c.inboxPrefix, t.UTC().Format(inboxDateFormat), key)
+}
+
+// inboxFinalKey returns the key an inbox key is promoted to.
+func (c *ssmConfig) inboxFinalKey(inboxKey string) (string, bool) {
+	rest := strings.TrimPrefix(inboxKey, c.inboxPrefix+"/")
+	if rest == inboxKey {
+		return "", false
+	}
+	i := strings.Index(rest, "/")
+	if i < 0 {
+		return "", false
+	}
+	_, err := time.Parse(inboxDateFormat, rest[:i])
+	if err != nil {
+		return "", false
+	}
+	key := rest[i+1:]
+	if key == "" || path.Clean(key) != key {
+		return "", false
+	}
+	return key, true
+}
+
+type UploadCompleteRequest struct {
+	ID       string `json:"id"`
+	InboxKey string `json:"inbox_key"`
+}
+
+type UploadCompleteResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	Key     string `json:"key"`
+}
+
+// handleUploadComplete promotes an upload from the inbox to its final key:
+// a server side copy followed by deleting the inbox object. It is safe to
+// retry; an upload that was already promoted gets the same response.
+func (s *server) handleUploadComplete(w http.ResponseWriter, r *http.Request) {
+	lgr := LgrFromContext(r.Context())
+
+	if r.Method != "POST" {
+		s.writeBadMethod(w)
+		return
+	}
+
+	conf := s.config()
+	if conf.inboxPrefix == "" {
+		s.writeError(w, http.StatusNotFound, errCodeNotFound, "uploads are not staged in an inbox")
+		return
+	}
+	if s.rejectReadOnly(w, lgr, conf) {
+		return
+	}
+
+	var req UploadCompleteRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMetadataBytes)).Decode(&req)
+	if err != nil {
+		lgr.Error("decode json err", "err", err)
+		s.writeError(w, http.StatusBadRequest, errCodeBadRequest, "bad request: "+err.Error())
+		return
+	}
+	lgr = lgr.New("id", req.ID, "inbox_key", req.InboxKey)
+
+	_, err = sha256Checksum(req.ID)
+	if err != nil {
+		lgr.Error("invalid_id", "err", err)
+		s.writeError(w, http.StatusBadRequest, errCodeInvalidID, "bad request: id must be the hex encoded sha256 of the file")
+		return
+	}
+
+	key, ok := conf.inboxFinalKey(req.InboxKey)
+	if !ok || !keyWithinPrefix(key, s.keyPrefix(conf, r)) {
+		lgr.Error("invalid_inbox_key")
+		s.writeError(w, http.StatusBadRequest, errCodeInvalidName, "invalid inbox_key")
+		return
+	}
+	lgr = lgr.New("key", key)
+
+	ctx := r.Context()
+	for _, bucket := range conf.allBuckets() {
+		bucket := bucket
+		head, err := s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    &req.InboxKey,
+		})
+		if err != nil {
+			continue
+		}
+		lgr = lgr.New("bucket", bucket)
+
+		if metadataValue(head.Metadata, "id") != req.ID {
+			lgr.Error("inbox_id_mismatch", "stored_id", metadataValue(head.Metadata, "id"))
+			s.writeError(w, http.StatusBadRequest, errCodeInvalidID, "inbox object has a different id")
+			return
+		}
+
+		existing, err := s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+		})
+		if err == nil && metadataValue(existing.Metadata, "id") != req.ID {
+			lgr.Error("promote_key_collision", "existing_id", metadataValue(existing.Metadata, "id"))
+			s.writeError(w, http.StatusConflict, errCodeKeyCollisions, "final key already holds a different file")
+			return
+		}
+		if err != nil {
+			err = s.promoteInbox(ctx, conf, bucket, req.InboxKey, key)
+			if err != nil {
+				lgr.Error("promote_err", "err", err)
+				s.writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to promote upload")
+				return
+			}
+		}
+
+		_, err = s.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: &bucket,
+			Key:    &req.InboxKey,
+		})
+		if err != nil {
+			// sweep-inbox cleans it up later
+			lgr.Warn("delete_inbox_err", "err", err)
+		}
+
+		lgr.Info("upload_complete_success")
+		json.NewEncoder(w).Encode(UploadCompleteResponse{
+			Status: StatusOK,
+			Key:    key,
+		})
+		return
+	}
+
+	// a retry after a successful promote finds the final key instead
+	for _, bucket := range conf.allBuckets() {
+		bucket := bucket
+		existing, err := s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+		})
+		if err == nil && metadataValue(existing.Metadata, "id") == req.ID {
+			lgr.Info("upload_already_promoted", "bucket", bucket)
+			json.NewEncoder(w).Encode(UploadCompleteResponse{
+				Status:  StatusOK,
+				Message: "upload already promoted",
+				Key:     key,
+			})
+			return
+		}
+	}
+
+	lgr.Error("inbox_object_not_found")
+	s.writeError(w, http.StatusNotFound, errCodeNotFound, "inbox object not found")
+}
+
+// promoteInbox copies inboxKey to key. Objects in the inbox came from a
+// single presigned PUT, so they are always within CopyObject's 5GB limit.
+// Metadata and tags are copied; the Object Lock retention uploads with an
+// expiry would have had is applied here from their expire-after tag.
+func (s *server) promoteInbox(ctx context.Context, conf *ssmConfig, bucket, inboxKey, key string) error {
+	input := &s3.CopyObjectInput{
+		Bucket:     &bucket,
+		Key:        &key,
+		CopySource: aws.String(copySource(bucket, inboxKey)),
+	}
+
+	if conf.objectLockMode != "" {
+		tags, err := s.s3.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+			Bucket: &bucket,
+			Key:    &inboxKey,
+		})
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags.TagSet {
+			if aws.StringValue(tag.Key) != "expire-after" {
+				continue
+			}
+			expireAt, err := time.Parse(time.RFC3339, aws.StringValue(tag.Value))
+			if err != nil {
+				return err
+			}
+			input.ObjectLockMode = aws.String(conf.objectLockMode)
+			input.ObjectLockRetainUntilDate = &expireAt
+		}
+	}
+
+	_, err := s.s3.CopyObjectWithContext(ctx, input)
+	return err
+}
+
+type sweepInboxReport struct {
+	Deleted int   `json:"deleted"`
+	Bytes   int64 `json:"bytes"`
+	Failed  int   `json:"failed"`
+}
+
+// sweepInboxTask deletes inbox objects older than -sweep-max-age. These
+// are uploads whose client never called /upload_complete. Nothing is
+// deleted without -apply.
+func (s *server) sweepInboxTask(ctx context.Context) (interface{}, error) {
+	conf := s.config()
+	var report sweepInboxReport
+	if conf.inboxPrefix == "" {
+		return &report, nil
+	}
+	cutoff := s.clock.Now().Add(-*sweepMaxAge)
+
+	for _, bucket := range conf.allBuckets() {
+		lgr := log15.New("bucket", bucket)
+
+		var stale []*s3.Object
+		err := s.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(conf.inboxPrefix + "/"),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				if aws.TimeValue(obj.LastModified).Before(cutoff) {
+					stale = append(stale, obj)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range stale {
+			olgr := lgr.New("key", aws.StringValue(obj.Key), "last_modified", aws.TimeValue(obj.LastModified))
+
+			if !applying() {
+				olgr.Info("sweep_inbox_would_delete", "bytes", aws.Int64Value(obj.Size))
+				report.Deleted++
+				report.Bytes += aws.Int64Value(obj.Size)
+				continue
+			}
+
+			_, err = s.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    obj.Key,
+			})
+			if err != nil {
+				olgr.Error("sweep_inbox_delete_err", "err", err)
+				report.Failed++
+				continue
+			}
+			olgr.Info("sweep_inbox_deleted", "bytes", aws.Int64Value(obj.Size))
+			report.Deleted++
+			report.Bytes += aws.Int64Value(obj.Size)
+		}
+	}
+
+	return &report, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSweepInboxApply(t *testing.T) {
+	defer func(a, d bool) { *apply, *dryRun = a, d }(*apply, *dryRun)
+
+	checks := []struct {
+		name       string
+		apply, dry bool
+		wantDelete bool
+	}{
+		{"default", false, false, false},
+		{"dry run", false, true, false},
+		{"apply", true, false, true},
+		{"apply and dry run", true, true, false},
+	}
+	for _, check := range checks {
+		t.Run(check.name, func(t *testing.T) {
+			*apply, *dryRun = check.apply, check.dry
+
+			client, deleted := fakeSweepS3(t, "inbox/2020-01-01/test.jpg")
+			s := &server{s3: client, clock: realClock{}}
+			s.conf.Store(&ssmConfig{bucket: "bucket", inboxPrefix: "inbox"})
+
+			out, err := s.sweepInboxTask(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			report := out.(*sweepInboxReport)
+			if report.Deleted != 1 {
+				t.Errorf("report.Deleted = %d, want 1", report.Deleted)
+			}
+			if got := len(deleted()) > 0; got != check.wantDelete {
+				t.Errorf("deleted %v, want delete %t", deleted(), check.wantDelete)
+			}
+		})
+	}
+}
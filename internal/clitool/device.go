@@ -0,0 +1,10 @@
+package clitool
+
+import "os"
+
+// Hostname returns the OS hostname, or an empty string if it can't be
+// determined. It is the default device name for uploads.
+func Hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
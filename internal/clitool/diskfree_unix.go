@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package clitool
+
+import "golang.org/x/sys/unix"
+
+// FreeSpace returns the number of bytes available to unprivileged users on
+// the filesystem containing dir.
+func FreeSpace(dir string) (uint64, error) {
+	var st unix.Statfs_t
+	err := unix.Statfs(dir, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
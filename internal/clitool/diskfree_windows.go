@@ -0,0 +1,8 @@
+package clitool
+
+import "errors"
+
+// FreeSpace is not implemented on windows.
+func FreeSpace(dir string) (uint64, error) {
+	return 0, errors.New("free space check not supported on windows")
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package clitool
+
+import "golang.org/x/sys/unix"
+
+// OpenFileLimit returns the soft limit on the number of open file
+// descriptors for the process.
+func OpenFileLimit() (uint64, error) {
+	var lim unix.Rlimit
+	err := unix.Getrlimit(unix.RLIMIT_NOFILE, &lim)
+	if err != nil {
+		return 0, err
+	}
+	return lim.Cur, nil
+}
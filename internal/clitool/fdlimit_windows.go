@@ -0,0 +1,8 @@
+package clitool
+
+import "errors"
+
+// OpenFileLimit is not implemented on windows.
+func OpenFileLimit() (uint64, error) {
+	return 0, errors.New("open file limit not supported on windows")
+}
@@ -0,0 +1,177 @@
+package clitool
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
+type HTTPConfig struct {
+	// CertFile and KeyFile are the client certificate to present for
+	// mutual TLS.
+	CertFile string
+	KeyFile  string
+
+	// Retries is the number of times a request with a replayable body is
+	// retried on a network error or a 502/503/504 response.
+	Retries int
+
+	// HTTP2 negotiates HTTP/2 over TLS when the server supports it.
+	// When false, requests always use HTTP/1.1.
+	HTTP2 bool
+
+	// Trace logs each request at debug level.
+	Trace bool
+}
+
+// NewHTTPClient returns an http.Client for the client tools. It is used for
+// both the requests to the upload_request handler and the PUTs to S3.
+func NewHTTPClient(conf HTTPConfig) (*http.Client, error) {
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return nil, fmt.Errorf("-client-cert and -client-key must be set together")
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	// the tools upload one file at a time, to the upload_request handler
+	// and then S3, so a couple of idle connections per host is enough
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     conf.HTTP2,
+		MaxIdleConns:          4,
+		MaxIdleConnsPerHost:   2,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	}
+
+	if conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client cert err: %w", err)
+		}
+		transport.TLSClientConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+	}
+
+	if !conf.HTTP2 {
+		// a non-nil, empty TLSNextProto disables HTTP/2
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	var rt http.RoundTripper = &protoLogTransport{
+		next:  transport,
+		http2: conf.HTTP2,
+		seen:  make(map[string]bool),
+	}
+	if conf.Trace {
+		rt = &traceTransport{next: rt}
+	}
+	if conf.Retries > 0 {
+		rt = &retryTransport{next: rt, retries: conf.Retries}
+	}
+
+	return &http.Client{
+		Transport: rt,
+	}, nil
+}
+
+// retryTransport retries requests whose body can be replayed (no body, or
+// GetBody set). Requests streaming a file body are left to the caller to
+// retry since only it can rewind the file.
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	if !replayable {
+		return t.next.RoundTrip(req)
+	}
+
+	backoff := 250 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if attempt >= t.retries || !retryable(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// protoLogTransport logs the negotiated protocol the first time it talks
+// to each host, warning if HTTP/2 was wanted but not negotiated.
+type protoLogTransport struct {
+	next  http.RoundTripper
+	http2 bool
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (t *protoLogTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	t.mu.Lock()
+	first := !t.seen[req.URL.Host]
+	t.seen[req.URL.Host] = true
+	t.mu.Unlock()
+
+	if first {
+		lgr := log15.New("host", req.URL.Host, "proto", resp.Proto)
+		if t.http2 && req.URL.Scheme == "https" && resp.ProtoMajor < 2 {
+			lgr.Warn("http2_not_negotiated")
+		} else {
+			lgr.Info("negotiated_protocol")
+		}
+	}
+
+	return resp, nil
+}
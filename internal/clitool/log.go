@@ -0,0 +1,52 @@
+package clitool
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
+// SetupLogging configures the root log15 logger to write to stderr at the
+// given level. debug overrides level and enables debug output. verbose
+// logs at debug level and quiet at warn level, except that records whose
+// message ends in _summary are always written.
+func SetupLogging(level string, debug, quiet, verbose bool) error {
+	if quiet && verbose {
+		return fmt.Errorf("-quiet and -verbose can't be used together")
+	}
+	if debug || verbose {
+		level = "debug"
+	} else if quiet {
+		level = "warn"
+	}
+
+	lvl, err := log15.LvlFromString(level)
+	if err != nil {
+		return fmt.Errorf("invalid -log-level %q: %w", level, err)
+	}
+
+	log15.Root().SetHandler(log15.FilterHandler(func(r *log15.Record) bool {
+		return r.Lvl <= lvl || (quiet && strings.HasSuffix(r.Msg, "_summary"))
+	}, log15.StderrHandler))
+	return nil
+}
+
+// traceTransport logs every request made through it at debug level.
+type traceTransport struct {
+	next http.RoundTripper
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	lgr := log15.New("method", req.Method, "host", req.URL.Host, "path", req.URL.Path, "duration_ms", time.Since(start).Milliseconds())
+	if err != nil {
+		lgr.Debug("http_request_err", "err", err)
+		return resp, err
+	}
+	lgr.Debug("http_request", "status", resp.StatusCode, "proto", resp.Proto, "content_length", req.ContentLength)
+	return resp, nil
+}
@@ -0,0 +1,60 @@
+// Package clitool contains helpers shared by the photo-backup command line
+// tools.
+package clitool
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// ResolvePassword returns the basic auth password from exactly one of:
+// the -password flag, the first line of -password-file, or an interactive
+// prompt when stdin is a terminal.
+func ResolvePassword(password, passwordFile string) (string, error) {
+	if password != "" && passwordFile != "" {
+		return "", errors.New("only one of -password and -password-file may be set")
+	}
+
+	if password != "" {
+		return password, nil
+	}
+
+	if passwordFile != "" {
+		f, err := os.Open(passwordFile)
+		if err != nil {
+			return "", fmt.Errorf("read password file err: %w", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		scanner.Scan()
+		if err := scanner.Err(); err != nil {
+			return "", fmt.Errorf("read password file err: %w", err)
+		}
+
+		pass := strings.TrimSpace(scanner.Text())
+		if pass == "" {
+			return "", fmt.Errorf("password file %s is empty", passwordFile)
+		}
+		return pass, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	pass, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("read password err: %w", err)
+	}
+
+	return string(pass), nil
+}
@@ -0,0 +1,88 @@
+package clitool
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/inconshreveable/log15"
+)
+
+// spoolReserveBytes is the free space left untouched on the spool
+// filesystem.
+const spoolReserveBytes = 64 << 20
+
+// Spool copies r to a temp file in dir (os.TempDir if empty) so it can be
+// read more than once. The returned cleanup func closes and removes the
+// file; it is also run if the process receives SIGINT or SIGTERM while
+// the spool file exists. Spooling fails early, rather than filling the
+// disk, if r is larger than the free space in dir.
+func Spool(r io.Reader, dir string) (f *os.File, cleanup func(), err error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	limit := int64(-1)
+	free, err := FreeSpace(dir)
+	if err == nil {
+		if free <= spoolReserveBytes {
+			return nil, nil, fmt.Errorf("not enough free space in %s to spool upload: %d bytes free", dir, free)
+		}
+		limit = int64(free - spoolReserveBytes)
+	} else {
+		log15.Warn("spool_free_space_check_err", "dir", dir, "err", err)
+	}
+
+	f, err = os.CreateTemp(dir, "photo-backup-spool-*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	remove := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	go func() {
+		select {
+		case sig := <-sigs:
+			remove()
+			log15.Error("interrupted, removed spool file", "signal", sig)
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+
+	cleanup = func() {
+		signal.Stop(sigs)
+		close(done)
+		remove()
+	}
+
+	var n int64
+	if limit >= 0 {
+		n, err = io.CopyN(f, r, limit+1)
+		if err == io.EOF {
+			err = nil
+		} else if err == nil && n > limit {
+			err = fmt.Errorf("not enough free space in %s to spool upload (%d bytes free)", dir, free)
+		}
+	} else {
+		n, err = io.Copy(f, r)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("spool upload: %w", err)
+	}
+
+	log15.Debug("spooled_upload", "path", f.Name(), "bytes", n)
+	return f, cleanup, nil
+}
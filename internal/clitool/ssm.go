@@ -0,0 +1,70 @@
+package clitool
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// SSMConfig is the server url and basic auth credentials read from SSM
+// Parameter Store for the -config-from-ssm flag.
+type SSMConfig struct {
+	URL      string
+	Username string
+	Password string
+}
+
+// LoadSSMConfig reads the url, username and password parameters under
+// prefix, e.g. /prod/photo-backup-client/url. Parameters that don't exist
+// are left empty.
+func LoadSSMConfig(prefix, region string) (*SSMConfig, error) {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	sess, err := session.NewSession(aws.NewConfig().WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ssm.New(sess).GetParameters(&ssm.GetParametersInput{
+		Names: []*string{
+			aws.String(prefix + "url"),
+			aws.String(prefix + "username"),
+			aws.String(prefix + "password"),
+		},
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read ssm config under %s err: %w", prefix, err)
+	}
+
+	var conf SSMConfig
+	for _, p := range resp.Parameters {
+		switch strings.TrimPrefix(aws.StringValue(p.Name), prefix) {
+		case "url":
+			conf.URL = aws.StringValue(p.Value)
+		case "username":
+			conf.Username = aws.StringValue(p.Value)
+		case "password":
+			conf.Password = aws.StringValue(p.Value)
+		}
+	}
+	return &conf, nil
+}
+
+// Apply fills in whichever of url, username and password weren't set by
+// flags. A password file counts as setting the password.
+func (c *SSMConfig) Apply(url, username, password *string, passwordFile string) {
+	if *url == "" {
+		*url = c.URL
+	}
+	if *username == "" {
+		*username = c.Username
+	}
+	if *password == "" && passwordFile == "" {
+		*password = c.Password
+	}
+}
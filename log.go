@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 
 	"github.com/inconshreveable/log15"
 )
@@ -9,7 +11,8 @@ import (
 type ctxKey string
 
 var (
-	lgrContextKey = ctxKey("lgr")
+	lgrContextKey       = ctxKey("lgr")
+	requestIDContextKey = ctxKey("request_id")
 )
 
 func LgrFromContext(ctx context.Context) log15.Logger {
@@ -23,3 +26,18 @@ func LgrFromContext(ctx context.Context) log15.Logger {
 func WithLgrContext(ctx context.Context, lgr log15.Logger) context.Context {
 	return context.WithValue(ctx, lgrContextKey, lgr)
 }
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, id)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLogMiddlewareFlush(t *testing.T) {
+	s := &server{stats: newServerStats(time.Now())}
+
+	release := make(chan struct{})
+	handler := s.logMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Error("wrapped writer is not an http.Hijacker")
+		}
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Error("wrapped writer is not an http.Flusher")
+			return
+		}
+		w.Write([]byte("first\n"))
+		f.Flush()
+		// the rest is only written once the client has read the flushed
+		// chunk, so the test hangs if the flush didn't reach it
+		<-release
+		w.Write([]byte("second\n"))
+	}))
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("X-Request-Id") == "" {
+		t.Error("missing X-Request-Id")
+	}
+
+	br := bufio.NewReader(resp.Body)
+	lines := make(chan string)
+	go func() {
+		line, _ := br.ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		if line != "first\n" {
+			t.Fatalf("first chunk = %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("flushed chunk never reached the client")
+	}
+	close(release)
+
+	line, err := br.ReadString('\n')
+	if err != nil || line != "second\n" {
+		t.Fatalf("second chunk = %q, err %v", line, err)
+	}
+}
@@ -1,21 +1,33 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"mime"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"path"
-	"path/filepath"
+	runtimedebug "runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/felixge/httpsnoop"
@@ -26,70 +38,196 @@ import (
 
 var (
 	addr    = flag.String("listen-addr", "127.0.0.1:1234", "Host/Port to listen on")
-	cliMode = flag.String("mode", "", "execution mode: http|lambda")
+	cliMode = flag.String("mode", os.Getenv("MODE"), "execution mode: http|lambda|<maintenance task>|lambda-<maintenance task>")
+
+	tlsCert        = flag.String("tls-cert", "", "TLS certificate file (http mode)")
+	tlsKey         = flag.String("tls-key", "", "TLS key file (http mode)")
+	clientCA       = flag.String("client-ca", "", "CA certificate file used to require and verify client certificates (http mode)")
+	certAuthOnly   = flag.Bool("client-cert-auth-only", false, "Accept a verified client certificate in place of basic auth")
+	certUserPrefix = flag.Bool("client-cert-user-prefix", false, "Store uploads under pathPrefix/<client cert common name>")
+
+	trustedProxyHops = flag.Int("trusted-proxy-hops", 0, "Number of proxies in front of the server whose X-Forwarded-For entries are trusted when logging the client ip")
+
+	logLevel = flag.String("log-level", "info", "Log level: debug|info|warn|error|crit")
+	debug    = flag.Bool("debug", false, "Enable debug logging, including tracing of AWS requests")
+
+	dryRun                = flag.Bool("dry-run", false, "Maintenance tasks report what they would do without changing anything, even with -apply")
+	apply                 = flag.Bool("apply", false, "Let sweep-multipart, sweep-inbox, sweep-test-uploads and migrate-keys change objects; without it they only report what they would do")
+	sweepMaxAge           = flag.Duration("sweep-max-age", 24*time.Hour, "sweep-multipart aborts multipart uploads and sweep-inbox deletes staged uploads older than this")
+	migrateDeleteOld      = flag.Bool("migrate-delete-old", false, "migrate-keys deletes each old key once it has been copied")
+	migrateFromTimeFormat = flag.String("migrate-from-time-format", defaultTimeFormat, "migrate-keys parses the timestamp of existing keys with this layout")
+	testUploadMaxAge      = flag.Duration("test-upload-max-age", 7*24*time.Hour, "sweep-test-uploads deletes test uploads older than this")
+	verifySamplePct       = flag.Float64("verify-sample-percent", 1, "verify-sample downloads and checks this percentage of objects")
+
+	startupWait = flag.Duration("startup-wait", 0, "Retry the initial SSM and S3 checks with backoff for up to this long before giving up (0 tries SSM once)")
+
+	ssmRefresh = flag.Duration("ssm-refresh-interval", 0, "Re-read SSM config on this interval (http mode, 0 disables)")
+
+	minBcryptCost = flag.Int("min-bcrypt-cost", 10, "Warn if the bcryptPass hash cost is below this value")
+
+	idFilterCapacity = flag.Int("id-filter-capacity", 0, "Keep an in-memory Bloom filter sized for this many ids to skip existence checks for new files (0 disables)")
+	idFilterRefresh  = flag.Duration("id-filter-refresh", 1*time.Hour, "Rebuild the id filter from s3 on this interval (0 builds it once)")
+
+	presignExpiry       = flag.Duration("presign-expiry", defaultPresignExpiry, "Upload URLs are valid for this long plus the time the file takes to send at -presign-min-bandwidth")
+	presignMinBandwidth = flag.Int64("presign-min-bandwidth", 256<<10, "Slowest upload speed, in bytes per second, that upload URLs leave time for (0 doesn't size URLs by file size)")
 
 	ssmPrefix = "/prod/lambda/photo-backup/"
 )
 
+const (
+	defaultRegion        = "us-east-1"
+	defaultPresignExpiry = 5 * time.Minute
+	defaultTimeFormat    = "2006-01-02-15_04_05.9"
+)
+
 func main() {
 	flag.Parse()
+	if *debug {
+		*logLevel = "debug"
+	}
+	lvl, err := log15.LvlFromString(*logLevel)
+	if err != nil {
+		panic(fmt.Errorf("invalid -log-level %q: %w", *logLevel, err))
+	}
 	logHandler := log15.StreamHandler(os.Stdout, log15.LogfmtFormat())
-	log15.Root().SetHandler(logHandler)
+	log15.Root().SetHandler(log15.LvlFilterHandler(lvl, logHandler))
 
 	kv := newKV()
 
-	bucket, err := kv.get("bucket")
-	if err != nil {
-		panic(err)
+	sess := session.Must(session.NewSession())
+	s3client := s3.New(sess, awsDebugConfig().WithRegion(defaultRegion))
+
+	var conf *ssmConfig
+	if *startupWait > 0 {
+		conf, err = waitReady(kv, s3client, *startupWait)
+	} else {
+		conf, err = loadSSMConfig(kv)
+		if err == nil {
+			err = checkBuckets(s3client, conf)
+		}
 	}
-	pathPrefix, err := kv.get("pathPrefix")
 	if err != nil {
 		panic(err)
 	}
 
-	bcryptPass, err := kv.get("bcryptPass")
-	if err != nil {
-		panic(err)
-	}
+	s := &server{
+		s3:    s3client,
+		clock: realClock{},
+		stats: newServerStats(time.Now()),
 
-	sess := session.Must(session.NewSession())
-	s3client := s3.New(sess, &aws.Config{
-		Region: aws.String("us-east-1"),
-	})
+		accelerateS3: s3.New(sess, awsDebugConfig().WithRegion(defaultRegion).WithS3UseAccelerate(true)),
 
-	s := &server{
-		s3:         s3client,
-		bucket:     bucket,
-		pathPrefix: pathPrefix,
-		bcryptPass: bcryptPass,
+		region:              defaultRegion,
+		presignExpiry:       *presignExpiry,
+		presignMinBandwidth: *presignMinBandwidth,
+
+		certAuthOnly:   *certAuthOnly,
+		certUserPrefix: *certUserPrefix,
 	}
+	s.conf.Store(conf)
+	s.logStartupConfig(*cliMode)
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/upload_request", s.handleUploadRequest)
+	mux := s.routes()
+	handler := s.logMiddleware(s.recoverMiddleware(s.basicAuthMiddleware(mux)))
 
-	handler := logMiddleware(s.basicAuthMiddleware(mux))
+	tasks := s.maintenanceTasks()
+	if task, ok := tasks[*cliMode]; ok {
+		runMaintenance(*cliMode, task)
+		return
+	}
+	if task, ok := tasks[strings.TrimPrefix(*cliMode, "lambda-")]; ok {
+		startMaintenanceLambda(*cliMode, task)
+		return
+	}
 
 	switch *cliMode {
 	case "http":
+		if *ssmRefresh > 0 {
+			go s.refreshSSMConfig(kv, *ssmRefresh)
+		}
+		if *idFilterCapacity > 0 {
+			go s.refreshIDFilter(*idFilterCapacity, *idFilterRefresh)
+		}
+
+		if *tlsCert != "" {
+			tlsConf, err := serverTLSConfig(*clientCA)
+			if err != nil {
+				panic(err)
+			}
+			httpServer := &http.Server{
+				Addr:      *addr,
+				Handler:   s.logMiddleware(s.recoverMiddleware(s.allowlistMiddleware(clientCertMiddleware(s.basicAuthMiddleware(mux))))),
+				TLSConfig: tlsConf,
+			}
+			fmt.Printf("Listening on %s (tls)\n", *addr)
+			panic(httpServer.ListenAndServeTLS(*tlsCert, *tlsKey))
+		}
+		if *clientCA != "" {
+			panic("-client-ca requires -tls-cert and -tls-key")
+		}
 		fmt.Printf("Listening on %s\n", *addr)
-		panic(http.ListenAndServe(*addr, handler))
+		panic(http.ListenAndServe(*addr, s.logMiddleware(s.recoverMiddleware(s.allowlistMiddleware(s.basicAuthMiddleware(mux))))))
 	default:
 		lambda.Start(lambdahttpv2.NewLambdaHandler(handler))
 	}
 }
 
+// allowlistMiddleware rejects clients outside the allowedCIDRs networks
+// before auth runs. It does nothing if no networks are configured.
+func (s *server) allowlistMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nets := s.config().allowedNets
+		if len(nets) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ipStr := clientIP(r, *trustedProxyHops)
+		if ip := net.ParseIP(ipStr); ip != nil {
+			for _, n := range nets {
+				if n.Contains(ip) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+
+		LgrFromContext(r.Context()).Warn("client_ip_denied", "client_ip", ipStr)
+		s.writeError(w, http.StatusForbidden, errCodeForbidden, "Forbidden")
+	})
+}
+
+// routes returns the server's handlers, before any middleware.
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload_request", s.handleUploadRequest)
+	mux.HandleFunc("/upload_complete", s.handleUploadComplete)
+	mux.HandleFunc("/run_manifest", s.handleRunManifest)
+	mux.HandleFunc("/download_batch", s.handleDownloadBatch)
+	mux.HandleFunc("/config", s.handleConfig)
+	mux.HandleFunc("/ids", s.handleIDs)
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/", s.handleNotFound)
+	return mux
+}
+
 func (s *server) basicAuthMiddleware(next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if s.certAuthOnly && ClientCNFromContext(r.Context()) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
 
 		_, password, authOK := r.BasicAuth()
 		if authOK == false {
-			http.Error(w, "Not authorized", 401)
+			s.writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "Not authorized")
 			return
 		}
 
-		if err := bcrypt.CompareHashAndPassword([]byte(s.bcryptPass), []byte(password)); err != nil {
-			http.Error(w, "Not authorized", 401)
+		if err := bcrypt.CompareHashAndPassword([]byte(s.config().bcryptPass), []byte(password)); err != nil {
+			s.writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "Not authorized")
 			return
 		}
 
@@ -97,27 +235,117 @@ func (s *server) basicAuthMiddleware(next http.Handler) http.HandlerFunc {
 	}
 }
 
-func logMiddleware(next http.Handler) http.Handler {
+// recoverMiddleware turns a handler panic into a logged error and a 500
+// response, so one bad request can't take down the server.
+func (s *server) recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				// deliberate abort, let net/http handle it
+				panic(p)
+			}
+
+			requestID := RequestIDFromContext(r.Context())
+			LgrFromContext(r.Context()).Error("handler_panic", "panic", fmt.Sprint(p), "stack", string(runtimedebug.Stack()))
+			s.writeErrorResponse(w, http.StatusInternalServerError, ErrorResponse{
+				Status:    StatusErr,
+				ErrorCode: errCodeInternal,
+				Error:     "internal error, request id " + requestID,
+				RequestID: requestID,
+			})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) logMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		url := *r.URL
 		host := r.Host
 
-		lgr := log15.New("url", url.String(), "host", host, "remote_addr", r.RemoteAddr)
+		requestID := newRequestID()
+		w.Header().Set("X-Request-Id", requestID)
+
+		lgr := log15.New("request_id", requestID, "url", url.String(), "host", host, "remote_addr", r.RemoteAddr, "client_ip", clientIP(r, *trustedProxyHops))
 
-		childCtx := WithLgrContext(r.Context(), lgr)
+		childCtx := WithRequestID(WithLgrContext(r.Context(), lgr), requestID)
 		childReq := r.WithContext(childCtx)
 
+		// httpsnoop wraps w preserving whichever of http.Flusher,
+		// http.Hijacker, io.ReaderFrom, etc. it implements, so streaming
+		// handlers work and Written counts every flushed chunk.
 		metrics := httpsnoop.CaptureMetrics(next, w, childReq)
+		s.stats.recordRequest(metrics.Duration)
 
 		lgr.Info("request", "status", metrics.Code, "duration_ms", metrics.Duration.Milliseconds(), "resp_size", metrics.Written, "method", r.Method, "proto", r.Proto)
 	})
 }
 
+// clientIP returns the address of the client that made r. X-Forwarded-For
+// is client controlled, so only the last trustedHops entries (the ones
+// appended by our own proxies) are believed; the client is the entry the
+// outermost trusted proxy appended. With no trusted hops, or no header, it
+// falls back to RemoteAddr.
+func clientIP(r *http.Request, trustedHops int) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	if trustedHops <= 0 {
+		return remote
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(h, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				hops = append(hops, addr)
+			}
+		}
+	}
+	if len(hops) == 0 {
+		return remote
+	}
+	if trustedHops > len(hops) {
+		return hops[0]
+	}
+	return hops[len(hops)-trustedHops]
+}
+
 type server struct {
-	s3         *s3.S3
-	bucket     string
-	pathPrefix string
-	bcryptPass string
+	s3    *s3.S3
+	clock Clock
+	stats *serverStats
+
+	// accelerateS3 presigns against the Transfer Acceleration endpoint
+	// when the accelerate config is set. All other calls use s3.
+	accelerateS3 *s3.S3
+
+	// conf holds the current *ssmConfig. It is swapped atomically when
+	// the config is refreshed from SSM.
+	conf atomic.Value
+
+	// idFilter holds the current *idFilter when -id-filter-capacity is set.
+	idFilter atomic.Value
+	// idFilterMu orders addKnownID against a rebuilt filter being swapped
+	// in. While a rebuild runs, idsDuringRebuild collects the ids presigned
+	// since it started listing.
+	idFilterMu       sync.Mutex
+	rebuildingFilter bool
+	idsDuringRebuild []string
+
+	region        string
+	presignExpiry time.Duration
+	// presignMinBandwidth, in bytes per second, sizes upload URLs by the
+	// file's size on top of presignExpiry (0 disables).
+	presignMinBandwidth int64
+
+	certAuthOnly   bool
+	certUserPrefix bool
 }
 
 type FileMetadata struct {
@@ -127,141 +355,822 @@ type FileMetadata struct {
 	Bytes       int64     `json:"size"`
 	ContentType string    `json:"content_type"`
 	TestUpload  bool      `json:"test_upload"`
+	Device      string    `json:"device,omitempty"` // originating device, e.g. hostname
+
+	// ValidateOnly runs all checks and returns the decision and key
+	// without presigning an upload URL.
+	ValidateOnly bool `json:"validate_only,omitempty"`
+
+	// Extra is additional metadata stored as x-amz-meta-<key>, e.g.
+	// fields from a sidecar file.
+	Extra map[string]string `json:"extra,omitempty"`
+
+	// ExpireAfter is an optional Go duration after which the object
+	// should be deleted by the bucket lifecycle.
+	ExpireAfter string `json:"expire_after,omitempty"`
+
+	// ThumbnailOf is the key of an uploaded original. If set, this file
+	// is stored as that original's thumbnail at <key>.thumb.jpg.
+	ThumbnailOf string `json:"thumbnail_of,omitempty"`
+
+	// PerceptualHash is an optional hex encoded 64 bit dHash of an
+	// image, stored as the phash tag for near-duplicate detection.
+	PerceptualHash string `json:"perceptual_hash,omitempty"`
+
+	// Album is an optional sub-prefix to store the upload under. It
+	// must be one of the server's allowedAlbums.
+	Album string `json:"album,omitempty"`
+
+	// Version is the client's protocol version; 0 means 1.
+	Version int `json:"version,omitempty"`
+
+	// Method is how the client will upload: PUT (the default) to a
+	// presigned URL, or POST with an S3 POST policy form.
+	Method string `json:"method,omitempty"`
 }
 
+const (
+	// protocolVersion is the version of the upload_request protocol the
+	// server speaks. Requests without a version are v1.
+	protocolVersion = 1
+	// minProtocolVersion is the oldest client protocol still accepted.
+	minProtocolVersion = 1
+)
+
 var (
 	StatusOK         = "ok"
 	StatusSkipUpload = "skip" // file already exists
 	StatusErr        = "error"
 )
 
+// Decisions returned for validate_only requests.
+var (
+	DecisionWouldUpload = "would-upload"
+	DecisionWouldSkip   = "would-skip"
+	DecisionWouldReject = "would-reject"
+)
+
+func (m FileMetadata) protocolVersion() int {
+	if m.Version == 0 {
+		return 1
+	}
+	return m.Version
+}
+
+// upgradeTarget is the side of a protocol version mismatch that is out
+// of date.
+func upgradeTarget(clientVersion int) string {
+	if clientVersion > protocolVersion {
+		return "server"
+	}
+	return "client"
+}
+
+// validateDecision returns decision for validate_only requests and "" for
+// normal ones.
+func validateDecision(meta FileMetadata, decision string) string {
+	if !meta.ValidateOnly {
+		return ""
+	}
+	return decision
+}
+
 type UploadDestination struct {
-	Status  string      `json:"status"`
-	Error   string      `json:"error,omitempty"`
-	URL     string      `json:"url"`
-	Method  string      `json:"method"`
-	Headers http.Header `json:"headers"`
+	Status   string      `json:"status"`
+	Version  int         `json:"version"` // server protocol version
+	Error    string      `json:"error,omitempty"`
+	Message  string      `json:"message,omitempty"`
+	Key      string      `json:"key,omitempty"`      // object key; the existing key for skip responses
+	Decision string      `json:"decision,omitempty"` // validate_only requests only
+	URL      string      `json:"url"`
+	Method   string      `json:"method"`
+	Headers  http.Header `json:"headers"`
+
+	// VerifyURL is a presigned HEAD of the uploaded object, for clients
+	// that check the upload was stored.
+	VerifyURL string `json:"verify_url,omitempty"`
+
+	// Marker, if set, is where the client writes a marker object after
+	// the upload succeeds.
+	Marker *MarkerDestination `json:"marker,omitempty"`
+
+	// InboxKey, if set, is the staging key URL uploads to. The client
+	// must POST it to /upload_complete to promote the object to Key.
+	InboxKey string `json:"inbox_key,omitempty"`
+
+	// ExpiresAt is when the signature on URL expires.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Fields are the form fields of a POST upload, sent before the file.
+	Fields map[string]string `json:"fields,omitempty"`
 }
 
 func (s *server) handleUploadRequest(w http.ResponseWriter, r *http.Request) {
 	lgr := LgrFromContext(r.Context())
 
 	if r.Method != "POST" {
-		http.Error(w, "Bad Method", http.StatusMethodNotAllowed)
+		s.writeBadMethod(w)
 		return
 	}
 
-	dec := json.NewDecoder(r.Body)
+	// one config for the whole request, so an SSM refresh can't mix the
+	// prefix, bucket and limits of two configs
+	conf := s.config()
 
-	var meta FileMetadata
-	err := dec.Decode(&meta)
+	meta, err := decodeMetadata(r.Header.Get("content-type"), http.MaxBytesReader(w, r.Body, maxMetadataBytes))
+	if errors.Is(err, errBodyTooLarge) {
+		lgr.Error("request_too_large", "max_bytes", maxMetadataBytes)
+		s.writeError(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, err.Error())
+		return
+	}
 	if err != nil {
 		lgr.Error("decode json err", "err", err)
-		resp := UploadDestination{
-			Status: StatusErr,
-			Error:  "bad request",
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(resp)
+		s.writeError(w, http.StatusBadRequest, errCodeBadRequest, "bad request: "+err.Error())
 		return
 	}
 
-	ts := meta.Mtime.Format("2006-01-02-15_04_05.9")
-	s3Path := path.Join(s.pathPrefix, ts+"-"+meta.ID+"-"+meta.Name)
-
 	lgr = lgr.New(
 		"id", meta.ID,
 		"filename", meta.Name,
-		"path", s3Path,
 		"size", meta.Bytes,
 		"content-type", meta.ContentType,
 		"mtime", meta.Mtime,
 		"test-upload", meta.TestUpload,
+		"device", meta.Device,
+		"expire-after", meta.ExpireAfter,
+		"thumbnail-of", meta.ThumbnailOf,
+		"album", meta.Album,
 	)
 
-	_, err = s.s3.HeadObject(&s3.HeadObjectInput{
-		Bucket: &s.bucket,
-		Key:    &s3Path,
-	})
+	if v := meta.protocolVersion(); v < minProtocolVersion || v > protocolVersion {
+		lgr.Error("unsupported_protocol_version", "version", v)
+		s.rejectUpload(w, meta, http.StatusBadRequest, errCodeBadVersion, fmt.Sprintf("protocol version %d is not supported: this server accepts versions %d to %d, upgrade the %s", v, minProtocolVersion, protocolVersion, upgradeTarget(v)))
+		return
+	}
 
-	if err == nil {
-		lgr.Error("filename_already_exists")
-		resp := UploadDestination{
-			Status: StatusSkipUpload,
-		}
-		w.WriteHeader(http.StatusConflict)
-		json.NewEncoder(w).Encode(resp)
+	// validate_only requests don't write anything, so plans still work
+	if !meta.ValidateOnly && s.rejectReadOnly(w, lgr, conf) {
+		return
+	}
+
+	checksum, err := sha256Checksum(meta.ID)
+	if err != nil {
+		lgr.Error("invalid_id", "err", err)
+		s.rejectUpload(w, meta, http.StatusBadRequest, errCodeInvalidID, "bad request: id must be the hex encoded sha256 of the file")
 		return
 	}
 
-	s3PathAltPrefix := path.Join(s.pathPrefix, meta.Mtime.Format("2006-01-02-15_04_05"))
+	if meta.Method != "" && meta.Method != uploadMethodPut && meta.Method != uploadMethodPost {
+		lgr.Error("invalid_upload_method", "method", meta.Method)
+		s.rejectUpload(w, meta, http.StatusBadRequest, errCodeBadRequest, "bad request: method must be PUT or POST")
+		return
+	}
 
-	objects, err := s.s3.ListObjects(&s3.ListObjectsInput{
-		Bucket: &s.bucket,
-		Prefix: &s3PathAltPrefix,
-	})
+	err = validateExtra(meta.Extra)
 	if err != nil {
-		lgr.Error("list_objects_err", "err", err)
-	}
-	for _, obj := range objects.Contents {
-		lgr.Info("ls_existing", "obj", *obj.Key)
-		// parts year-month-day-hourminuteetc-id-name
-		_, fname := filepath.Split(*obj.Key)
-		parts := strings.SplitN(fname, "-", 6)
-		if len(parts) > 4 {
-			gotID := parts[4]
-			if gotID == meta.ID {
-				lgr.Error("filename_already_exists_different_s3_path", "new_path", s3Path, "old_path", *obj.Key)
-				resp := UploadDestination{
-					Status: StatusSkipUpload,
-				}
-				w.WriteHeader(http.StatusConflict)
-				json.NewEncoder(w).Encode(resp)
+		lgr.Error("invalid_extra_metadata", "err", err)
+		s.rejectUpload(w, meta, http.StatusBadRequest, errCodeBadRequest, "bad request: "+err.Error())
+		return
+	}
+
+	if conf.extensionCheck != extensionCheckOff {
+		if extType, ok := extensionMatchesType(meta.Name, meta.ContentType); !ok {
+			if conf.extensionCheck == extensionCheckReject {
+				lgr.Error("extension_type_mismatch", "extension_type", extType)
+				s.rejectUpload(w, meta, http.StatusBadRequest, errCodeTypeMismatch, fmt.Sprintf("bad request: name extension is %s but content_type is %s", extType, meta.ContentType))
 				return
 			}
+			lgr.Warn("extension_type_mismatch", "extension_type", extType)
+		}
+	}
+
+	objMetadata := objectMetadata(meta)
+	if size := metadataSize(objMetadata); size > maxUserMetadataBytes {
+		lgr.Error("metadata_too_large", "bytes", size, "max_bytes", maxUserMetadataBytes)
+		s.rejectUpload(w, meta, http.StatusBadRequest, errCodeMetadataTooLarge, fmt.Sprintf("bad request: metadata is %d bytes, max is %d", size, maxUserMetadataBytes))
+		return
+	}
+
+	if meta.PerceptualHash != "" && !validPerceptualHash(meta.PerceptualHash) {
+		lgr.Error("invalid_perceptual_hash", "perceptual_hash", meta.PerceptualHash)
+		s.rejectUpload(w, meta, http.StatusBadRequest, errCodeBadRequest, "bad request: perceptual_hash must be 16 lowercase hex characters")
+		return
+	}
+
+	if limit, typ := conf.maxUploadFor(meta.ContentType); limit > 0 && meta.Bytes > limit {
+		lgr.Error("upload_too_large", "max_bytes", limit, "limit_type", typ)
+		if typ != "" {
+			s.rejectUpload(w, meta, http.StatusRequestEntityTooLarge, errCodeTypeSizeLimit, fmt.Sprintf("file is %d bytes, the %s limit is %d", meta.Bytes, typ, limit))
+		} else {
+			s.rejectUpload(w, meta, http.StatusRequestEntityTooLarge, errCodeSizeLimit, fmt.Sprintf("file is %d bytes, the limit is %d", meta.Bytes, limit))
+		}
+		return
+	}
+
+	var expireAfter time.Duration
+	if meta.ExpireAfter != "" {
+		expireAfter, err = time.ParseDuration(meta.ExpireAfter)
+		if err != nil || expireAfter <= 0 {
+			lgr.Error("invalid_expire_after", "err", err)
+			s.rejectUpload(w, meta, http.StatusBadRequest, errCodeBadRequest, "bad request: expire_after must be a positive duration")
+			return
+		}
+	}
+
+	prefix := s.keyPrefix(conf, r)
+	if meta.Album != "" {
+		album, ok := conf.album(meta.Album)
+		if !ok {
+			lgr.Error("album_not_allowed", "album", meta.Album)
+			s.rejectUpload(w, meta, http.StatusForbidden, errCodeAlbumNotAllowed, "album is not in the server's allowed albums")
+			return
+		}
+		prefix = path.Join(prefix, album)
+	}
+	// new keys go under the content-type's sub-prefix, if it has one
+	typedPrefix := conf.typePrefix(prefix, meta.ContentType)
+	bucket := conf.bucketFor(meta)
+
+	var s3Path string
+	checkExisting := true
+	if meta.ThumbnailOf != "" {
+		if !keyWithinPrefix(meta.ThumbnailOf, prefix) || len(meta.ThumbnailOf)+len(thumbnailSuffix) > maxKeyBytes {
+			lgr.Error("invalid_thumbnail_of", "thumbnail_of", meta.ThumbnailOf)
+			s.rejectUpload(w, meta, http.StatusBadRequest, errCodeInvalidName, "invalid thumbnail_of key")
+			return
+		}
+		// thumbnails are stored next to their original
+		var ok bool
+		bucket, ok = s.findObject(conf, meta.ThumbnailOf)
+		if !ok {
+			lgr.Error("thumbnail_original_not_found", "thumbnail_of", meta.ThumbnailOf)
+			s.rejectUpload(w, meta, http.StatusBadRequest, errCodeOriginalNotFound, "original object for thumbnail not found")
+			return
+		}
+		s3Path = meta.ThumbnailOf + thumbnailSuffix
+
+		_, err := s.s3.HeadObject(&s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    &s3Path,
+		})
+		if err == nil {
+			lgr.Info("thumbnail_already_exists", "existing_path", s3Path)
+			resp := UploadDestination{
+				Status:   StatusSkipUpload,
+				Version:  protocolVersion,
+				Message:  "thumbnail already exists",
+				Key:      s3Path,
+				Decision: validateDecision(meta, DecisionWouldSkip),
+			}
+			s.stats.recordSkip()
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		checkExisting = false
+	} else if f := s.knownIDFilter(); f != nil && !f.mayContain(meta.ID) {
+		// a definite miss in the id filter means neither the key (which
+		// contains the id) nor an alt-prefix copy can exist
+		checkExisting = false
+		lgr.Debug("id_filter_miss")
+	}
+	lgr = lgr.New("bucket", bucket)
+
+	for seq := 0; s3Path == ""; seq++ {
+		key, truncated := s.objectKey(conf, typedPrefix, meta, seq)
+		if truncated && seq == 0 {
+			lgr.Warn("key_name_truncated", "key", key, "max_key_bytes", maxKeyBytes)
+		}
+		// checked before any s3 call, so a name with ".." segments can't
+		// even probe for objects outside the prefix
+		if !keyWithinPrefix(key, prefix) {
+			lgr.Error("key_outside_prefix", "key", key, "prefix", prefix)
+			s.rejectUpload(w, meta, http.StatusBadRequest, errCodeInvalidName, "invalid name")
+			return
+		}
+		if !checkExisting {
+			s3Path = key
+			break
+		}
+		head, err := s.s3.HeadObject(&s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+		})
+		if isNoSuchBucket(err) {
+			s.rejectMissingBucket(w, lgr, meta, bucket, err)
+			return
+		}
+		if err != nil {
+			s3Path = key
+			break
+		}
+
+		storedID := metadataValue(head.Metadata, "id")
+		if storedID == "" || storedID == meta.ID {
+			lgr.Error("filename_already_exists", "existing_path", key)
+			resp := UploadDestination{
+				Status:   StatusSkipUpload,
+				Version:  protocolVersion,
+				Message:  "file already exists",
+				Key:      key,
+				Decision: validateDecision(meta, DecisionWouldSkip),
+			}
+			s.stats.recordSkip()
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+
+		lgr.Info("key_collision", "existing_path", key, "existing_id", storedID)
+		if seq >= maxKeyCollisions {
+			lgr.Error("too_many_key_collisions")
+			s.rejectUpload(w, meta, http.StatusInternalServerError, errCodeKeyCollisions, "too many key collisions")
+			return
+		}
+	}
+	lgr = lgr.New("path", s3Path)
+
+	if checkExisting {
+		altFormat := conf.timeFormat
+		if altFormat == defaultTimeFormat {
+			// also match keys from before sub-second precision was added
+			altFormat = "2006-01-02-15_04_05"
 		}
+		shardPrefix := path.Join(typedPrefix, idShardPath(meta.ID, conf.idShardChars))
+		s3PathAltPrefix := path.Join(shardPrefix, meta.Mtime.Format(altFormat))
+
+		objects, err := s.s3.ListObjects(&s3.ListObjectsInput{
+			Bucket: &bucket,
+			Prefix: &s3PathAltPrefix,
+		})
+		if isNoSuchBucket(err) {
+			s.rejectMissingBucket(w, lgr, meta, bucket, err)
+			return
+		}
+		if err != nil {
+			lgr.Error("list_objects_err", "err", err)
+		}
+		for _, obj := range objects.Contents {
+			lgr.Info("ls_existing", "obj", *obj.Key)
+			if gotID := idFromKey(*obj.Key); gotID != "" {
+				if gotID == meta.ID {
+					lgr.Error("filename_already_exists_different_s3_path", "new_path", s3Path, "old_path", *obj.Key)
+					resp := UploadDestination{
+						Status:   StatusSkipUpload,
+						Version:  protocolVersion,
+						Message:  "file already exists under a different key",
+						Key:      *obj.Key,
+						Decision: validateDecision(meta, DecisionWouldSkip),
+					}
+					s.stats.recordSkip()
+					w.WriteHeader(http.StatusConflict)
+					json.NewEncoder(w).Encode(resp)
+					return
+				}
+			}
+		}
+	}
+
+	if meta.ValidateOnly {
+		lgr.Info("validate_only_would_upload")
+		resp := UploadDestination{
+			Status:   StatusOK,
+			Version:  protocolVersion,
+			Key:      s3Path,
+			Decision: DecisionWouldUpload,
+		}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	putKey := s3Path
+	if conf.inboxPrefix != "" {
+		putKey = conf.inboxKey(s.clock.Now(), s3Path)
+		lgr = lgr.New("inbox_key", putKey)
 	}
 
 	putObjInput := &s3.PutObjectInput{
-		Bucket:        &s.bucket,
-		Key:           aws.String(s3Path),
+		Bucket:        &bucket,
+		Key:           aws.String(putKey),
 		ContentLength: aws.Int64(meta.Bytes),
 		ContentType:   aws.String(meta.ContentType),
-		Metadata: map[string]*string{
-			"filename": aws.String(meta.Name),
-			"mtime":    aws.String(meta.Mtime.Format(time.RFC3339)),
-		},
+		Metadata:      objMetadata,
 	}
 
-	if meta.TestUpload {
-		putObjInput.Metadata["test-upload"] = aws.String("true")
-	}
+	// S3 rejects the PUT if the uploaded bytes don't hash to the id
+	signedHeaders := make(http.Header)
+	signedHeaders.Set("x-amz-checksum-sha256", checksum)
 
-	req, _ := s.s3.PutObjectRequest(putObjInput)
+	tags := make(neturl.Values)
+	if meta.PerceptualHash != "" {
+		tags.Set("phash", meta.PerceptualHash)
+	}
+	if expireAfter > 0 {
+		expireAt := s.clock.Now().Add(expireAfter).UTC().Format(time.RFC3339)
+		// the bucket lifecycle acts on this tag
+		tags.Set("expire-after", expireAt)
+		// a locked inbox object couldn't be deleted once promoted, so
+		// the lock is applied by /upload_complete instead
+		if conf.objectLockMode != "" && conf.inboxPrefix == "" {
+			signedHeaders.Set("x-amz-object-lock-mode", conf.objectLockMode)
+			signedHeaders.Set("x-amz-object-lock-retain-until-date", expireAt)
+		}
+		lgr = lgr.New("expire_at", expireAt)
+	}
+	if len(tags) > 0 {
+		signedHeaders.Set("x-amz-tagging", tags.Encode())
+	}
 
-	url, err := req.Presign(1 * time.Minute)
+	expiry := s.uploadExpiry(meta.Bytes)
+	expiresAt := s.clock.Now().Add(expiry)
+	resp := UploadDestination{
+		Status:    StatusOK,
+		Version:   protocolVersion,
+		Key:       s3Path,
+		Method:    uploadMethodPut,
+		ExpiresAt: &expiresAt,
+	}
+	if meta.Method == uploadMethodPost {
+		resp.Method = uploadMethodPost
+		resp.URL, resp.Fields, err = s.presignPost(lgr, putObjInput, signedHeaders, expiresAt)
+	} else {
+		resp.URL, err = s.presignPut(lgr, putObjInput, signedHeaders, expiry)
+	}
 	if err != nil {
-		fmt.Println("error presigning request", err)
+		lgr.Error("presign_err", "method", resp.Method, "err", err)
+		s.writeError(w, http.StatusInternalServerError, errCodePresignFailed, "failed to presign upload")
 		return
 	}
 
-	resp := UploadDestination{
-		Status: StatusOK,
-		URL:    url,
-		Method: "PUT",
+	s.addKnownID(meta.ID)
+
+	if resp.Method == uploadMethodPut {
+		resp.Headers = make(http.Header)
+		resp.Headers.Set("content-length", strconv.Itoa(int(meta.Bytes)))
+		resp.Headers.Set("content-type", meta.ContentType)
+		for k, v := range putObjInput.Metadata {
+			resp.Headers.Set("x-amz-meta-"+k, *v)
+		}
+		for k := range signedHeaders {
+			resp.Headers.Set(k, signedHeaders.Get(k))
+		}
+	}
+
+	if putKey != s3Path {
+		resp.InboxKey = putKey
 	}
-	resp.Headers = make(http.Header)
-	resp.Headers.Set("content-length", strconv.Itoa(int(meta.Bytes)))
-	resp.Headers.Set("content-type", meta.ContentType)
-	for k, v := range putObjInput.Metadata {
-		resp.Headers.Set("x-amz-meta-"+k, *v)
+
+	resp.VerifyURL, err = s.presignHead(lgr, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    aws.String(putKey),
+	}, postUploadExpiry)
+	if err != nil {
+		lgr.Warn("verify_presign_err", "err", err)
+	}
+
+	if conf.markerPrefix != "" {
+		// markers are best effort, don't fail the upload over one
+		resp.Marker, err = s.presignMarker(lgr, conf, bucket, s3Path, meta)
+		if err != nil {
+			lgr.Warn("marker_presign_err", "err", err)
+		}
 	}
 
+	s.stats.recordGranted(meta.Bytes)
 	lgr.Info("upload_request_success")
 
 	json.NewEncoder(w).Encode(resp)
 }
 
+const (
+	presignRetries = 2
+	presignBackoff = 100 * time.Millisecond
+
+	// postUploadExpiry is how long URLs the client only uses once its
+	// upload has finished (verify, marker) stay valid. Uploads can take
+	// much longer than presignExpiry.
+	postUploadExpiry = 6 * time.Hour
+)
+
+// maxPresignExpiry is the longest a SigV4 presigned URL can be valid.
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// uploadExpiry returns how long the URL for an upload of size bytes stays
+// valid: presignExpiry plus the time the upload takes at
+// presignMinBandwidth, so large files don't get URLs that expire before
+// they can finish.
+func (s *server) uploadExpiry(size int64) time.Duration {
+	expiry := s.presignExpiry
+	if s.presignMinBandwidth > 0 {
+		expiry += time.Duration(float64(size) / float64(s.presignMinBandwidth) * float64(time.Second))
+	}
+	if expiry > maxPresignExpiry {
+		expiry = maxPresignExpiry
+	}
+	return expiry
+}
+
+// presignPut presigns a PutObject request. extraHeaders are added to the
+// signature and must be sent by the client.
+func (s *server) presignPut(lgr log15.Logger, input *s3.PutObjectInput, extraHeaders http.Header, expiry time.Duration) (string, error) {
+	return s.presign(lgr, expiry, func() *request.Request {
+		req, _ := s.presignClient().PutObjectRequest(input)
+		for k := range extraHeaders {
+			req.HTTPRequest.Header.Set(k, extraHeaders.Get(k))
+		}
+		return req
+	})
+}
+
+// presignHead presigns a HeadObject request.
+func (s *server) presignHead(lgr log15.Logger, input *s3.HeadObjectInput, expiry time.Duration) (string, error) {
+	return s.presign(lgr, expiry, func() *request.Request {
+		req, _ := s.presignClient().HeadObjectRequest(input)
+		return req
+	})
+}
+
+// presignClient returns the s3 client URLs are presigned with.
+func (s *server) presignClient() *s3.S3 {
+	if s.config().accelerate && s.accelerateS3 != nil {
+		return s.accelerateS3
+	}
+	return s.s3
+}
+
+// presign presigns the request built by newReq. Presigning resolves
+// credentials, which can fail transiently (e.g. assumed-role creds that
+// need a refresh), so failures are retried with exponential backoff after
+// forcing the credentials to be re-fetched.
+func (s *server) presign(lgr log15.Logger, expiry time.Duration, newReq func() *request.Request) (string, error) {
+	backoff := presignBackoff
+	for attempt := 0; ; attempt++ {
+		req := newReq()
+		// keep extra x-amz-* headers as signed headers instead of hoisting
+		// them into the query string
+		req.NotHoist = true
+		// sign with the server clock rather than time.Now
+		req.Handlers.Sign.Swap(v4.SignRequestHandler.Name, request.NamedHandler{
+			Name: v4.SignRequestHandler.Name,
+			Fn: func(r *request.Request) {
+				v4.SignSDKRequestWithCurrentTime(r, s.clock.Now, func(signer *v4.Signer) {
+					signer.DisableURIPathEscaping = true
+				})
+			},
+		})
+		url, _, err := req.PresignRequest(expiry)
+		if err == nil {
+			return url, nil
+		}
+		if attempt >= presignRetries {
+			return "", err
+		}
+
+		lgr.Warn("presign_retry", "attempt", attempt+1, "backoff", backoff, "err", err)
+		if creds := s.s3.Config.Credentials; creds != nil {
+			creds.Expire()
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// sha256Checksum converts a hex encoded sha256 id to the base64 form used
+// by the x-amz-checksum-sha256 header.
+func sha256Checksum(id string) (string, error) {
+	sum, err := hex.DecodeString(id)
+	if err != nil {
+		return "", err
+	}
+	if len(sum) != sha256.Size {
+		return "", fmt.Errorf("id is %d bytes, expected %d", len(sum), sha256.Size)
+	}
+	return base64.StdEncoding.EncodeToString(sum), nil
+}
+
+// maxMetadataBytes is the largest upload_request body accepted.
+const maxMetadataBytes = 64 << 10
+
+// maxKeyCollisions is the number of sequence suffixes tried when an existing
+// object with a different id already occupies a key.
+const maxKeyCollisions = 100
+
+// maxKeyBytes is the S3 limit on object key length.
+const maxKeyBytes = 1024
+
+// objectKey returns the s3 key for meta. A non-zero seq is appended to the
+// name (before the extension) to disambiguate distinct files that would
+// otherwise map to the same key. If the key would exceed maxKeyBytes the
+// name is truncated, keeping its extension; truncated reports whether that
+// happened. The id is part of the key so truncated keys stay unique.
+func (s *server) objectKey(conf *ssmConfig, prefix string, meta FileMetadata, seq int) (key string, truncated bool) {
+	prefix = path.Join(prefix, idShardPath(meta.ID, conf.idShardChars))
+	ts := meta.Mtime.Format(conf.timeFormat)
+	ext := path.Ext(meta.Name)
+	base := strings.TrimSuffix(meta.Name, ext)
+	if seq > 0 {
+		ext = "-" + strconv.Itoa(seq) + ext
+	}
+
+	key = path.Join(prefix, ts+"-"+meta.ID+"-"+base+ext)
+	if over := len(key) - maxKeyBytes; over > 0 {
+		base = truncateUTF8(base, len(base)-over)
+		key = path.Join(prefix, ts+"-"+meta.ID+"-"+base+ext)
+		truncated = true
+	}
+	return key, truncated
+}
+
+// idShardPath returns the first n characters of id as two character path
+// segments, e.g. "ab/cd" for n=4.
+func idShardPath(id string, n int) string {
+	if n > len(id) {
+		n = len(id)
+	}
+	segments := make([]string, 0, n/2)
+	for i := 0; i+2 <= n; i += 2 {
+		segments = append(segments, id[i:i+2])
+	}
+	return strings.Join(segments, "/")
+}
+
+// keyWithinPrefix reports whether key, after path cleaning, is strictly
+// inside prefix. This guards against names containing ".." or leading
+// slashes producing keys outside the intended area.
+func keyWithinPrefix(key, prefix string) bool {
+	cleanKey := path.Clean(key)
+	if cleanKey != key {
+		return false
+	}
+
+	cleanPrefix := path.Clean(prefix)
+	switch cleanPrefix {
+	case ".":
+		return cleanKey != ".." && !strings.HasPrefix(cleanKey, "../") && !strings.HasPrefix(cleanKey, "/")
+	case "/":
+		return cleanKey != "/" && strings.HasPrefix(cleanKey, "/")
+	}
+	return strings.HasPrefix(cleanKey, cleanPrefix+"/")
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a
+// multi-byte character.
+func truncateUTF8(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// keyPrefix returns the key prefix uploads for r are stored under.
+func (s *server) keyPrefix(conf *ssmConfig, r *http.Request) string {
+	return path.Join(conf.pathPrefix, s.userDir(r))
+}
+
+// userDir is the per-user directory of -client-cert-user-prefix, or ""
+// when uploads aren't split by user.
+func (s *server) userDir(r *http.Request) string {
+	if s.certUserPrefix {
+		if cn := ClientCNFromContext(r.Context()); cn != "" {
+			return path.Base(path.Clean("/" + cn))
+		}
+	}
+	return ""
+}
+
+// maxUserMetadataBytes is the S3 limit on the total size of the
+// user-defined metadata keys and values of an object.
+const maxUserMetadataBytes = 2 << 10
+
+// objectMetadata returns the user-defined metadata stored with meta's
+// object.
+func objectMetadata(meta FileMetadata) map[string]*string {
+	md := map[string]*string{
+		"id":       aws.String(meta.ID),
+		"filename": aws.String(meta.Name),
+		"mtime":    aws.String(meta.Mtime.Format(time.RFC3339)),
+	}
+	if meta.TestUpload {
+		md["test-upload"] = aws.String("true")
+	}
+	if meta.Device != "" {
+		md["device"] = aws.String(meta.Device)
+	}
+	if meta.ThumbnailOf != "" {
+		md["thumbnail-of"] = aws.String(meta.ThumbnailOf)
+	}
+	for k, v := range meta.Extra {
+		// header values must be ascii
+		md[k] = aws.String(mime.QEncoding.Encode("utf-8", v))
+	}
+	return md
+}
+
+func metadataSize(md map[string]*string) int {
+	var n int
+	for k, v := range md {
+		n += len(k) + len(*v)
+	}
+	return n
+}
+
+// reservedMetadataKeys are set by the server and can't be overridden with
+// FileMetadata.Extra.
+var reservedMetadataKeys = map[string]bool{
+	"id":           true,
+	"filename":     true,
+	"mtime":        true,
+	"test-upload":  true,
+	"device":       true,
+	"thumbnail-of": true,
+}
+
+// validateExtra checks that every Extra key is usable as an
+// x-amz-meta-<key> header: lowercase letters, digits and hyphens only.
+func validateExtra(extra map[string]string) error {
+	for k := range extra {
+		if k == "" {
+			return errors.New("empty extra metadata key")
+		}
+		if reservedMetadataKeys[k] {
+			return fmt.Errorf("extra metadata key %q is reserved", k)
+		}
+		for _, c := range k {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("invalid extra metadata key %q", k)
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	extensionCheckOff    = "off"
+	extensionCheckWarn   = "warn"
+	extensionCheckReject = "reject"
+)
+
+// extensionMatchesType reports whether name's extension is consistent with
+// contentType. Extensions and types the mime package doesn't know, and the
+// generic application/octet-stream type, are always accepted. It also returns the
+// type the extension maps to.
+func extensionMatchesType(name, contentType string) (string, bool) {
+	ext := path.Ext(name)
+	if ext == "" {
+		return "", true
+	}
+	extType, _, err := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(ext)))
+	if err != nil {
+		return "", true
+	}
+	declared, _, err := mime.ParseMediaType(contentType)
+	if err != nil || declared == "application/octet-stream" || declared == extType {
+		return extType, true
+	}
+	// an extension can belong to more than one type (.heic is image/heic
+	// and image/heif)
+	exts, _ := mime.ExtensionsByType(declared)
+	if len(exts) == 0 {
+		return extType, true
+	}
+	for _, e := range exts {
+		if strings.EqualFold(e, ext) {
+			return extType, true
+		}
+	}
+	return extType, false
+}
+
+// validPerceptualHash reports whether h is a hex encoded 64 bit hash.
+func validPerceptualHash(h string) bool {
+	if len(h) != 16 {
+		return false
+	}
+	for _, c := range h {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// metadataValue looks up a user metadata value by key. The s3 client
+// canonicalizes metadata keys on read so the lookup is case-insensitive.
+func metadataValue(md map[string]*string, key string) string {
+	for k, v := range md {
+		if strings.EqualFold(k, key) && v != nil {
+			return *v
+		}
+	}
+	return ""
+}
+
 func (kv *kv) get(key string) (string, error) {
 	path := ssmPrefix + key
 	req := ssm.GetParameterInput{
@@ -280,9 +1189,34 @@ func (kv *kv) get(key string) (string, error) {
 	return *val, nil
 }
 
+// awsDebugConfig returns an aws.Config that traces AWS requests to the
+// debug log when -debug is set.
+func awsDebugConfig() *aws.Config {
+	conf := aws.NewConfig()
+	if *debug {
+		conf = conf.
+			WithLogLevel(aws.LogDebugWithRequestRetries | aws.LogDebugWithRequestErrors).
+			WithLogger(aws.LoggerFunc(func(args ...interface{}) {
+				log15.Debug("aws", "msg", fmt.Sprint(args...))
+			}))
+	}
+	return conf
+}
+
+// getOptional is like get but returns an empty string if the parameter
+// does not exist.
+func (kv *kv) getOptional(key string) (string, error) {
+	val, err := kv.get(key)
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == ssm.ErrCodeParameterNotFound {
+		return "", nil
+	}
+	return val, err
+}
+
 func newKV() *kv {
 	sess := session.Must(session.NewSession())
-	ssmClient := ssm.New(sess)
+	ssmClient := ssm.New(sess, awsDebugConfig())
 
 	return &kv{
 		client: ssmClient,
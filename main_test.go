@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestKeyWithinPrefix(t *testing.T) {
+	checks := []struct {
+		key, prefix string
+		want        bool
+	}{
+		{"photos/a.jpg", "photos", true},
+		{"photos/2021/a.jpg", "photos/", true},
+		{"photos", "photos", false},
+		{"photos/", "photos", false},
+		{"photosx/a.jpg", "photos", false},
+		{"photos/../a.jpg", "photos", false},
+		{"photos/./a.jpg", "photos", false},
+		{"photos//a.jpg", "photos", false},
+		{"a.jpg", "photos", false},
+		{"/photos/a.jpg", "photos", false},
+		{"a.jpg", "", true},
+		{"..", "", false},
+		{"../a.jpg", "", false},
+		{"/a.jpg", "", false},
+		{"/a.jpg", "/", true},
+		{"a.jpg", "/", false},
+	}
+	for _, check := range checks {
+		got := keyWithinPrefix(check.key, check.prefix)
+		if got != check.want {
+			t.Errorf("keyWithinPrefix(%q, %q) = %t, want %t", check.key, check.prefix, got, check.want)
+		}
+	}
+}
+
+func TestObjectKeyAdversarialNames(t *testing.T) {
+	s := &server{}
+	conf := &ssmConfig{timeFormat: defaultTimeFormat, idShardChars: 2}
+	meta := FileMetadata{
+		ID:    strings.Repeat("ab", 32),
+		Mtime: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+	prefix := "photos/alice"
+
+	names := []string{
+		"IMG_0001.jpg",
+		"../IMG_0001.jpg",
+		"../../../../IMG_0001.jpg",
+		"/../../../etc/passwd",
+		"a/../../../../b.jpg",
+		"..",
+		"../..",
+		"/",
+		"//",
+		"./././../../x.jpg",
+		strings.Repeat("../", 400) + "x.jpg",
+		"..\\..\\x.jpg",
+		"x.jpg\x00/../../..",
+	}
+	for _, name := range names {
+		meta.Name = name
+		for _, seq := range []int{0, 1} {
+			key, _ := s.objectKey(conf, prefix, meta, seq)
+			escapes := resolvesOutside(key, prefix)
+			if escapes && keyWithinPrefix(key, prefix) {
+				t.Errorf("name %q: key %q is outside %q but passed keyWithinPrefix", name, key, prefix)
+			}
+			if !escapes && !keyWithinPrefix(key, prefix) {
+				t.Errorf("name %q: key %q is inside %q but failed keyWithinPrefix", name, key, prefix)
+			}
+		}
+	}
+
+	meta.Name = "../../../../IMG_0001.jpg"
+	key, _ := s.objectKey(conf, prefix, meta, 0)
+	if keyWithinPrefix(key, prefix) {
+		t.Errorf("traversal name produced key %q that passed the prefix check", key)
+	}
+}
+
+// resolvesOutside reports whether key, read as a path with its "." and ".."
+// segments applied, names something outside prefix.
+func resolvesOutside(key, prefix string) bool {
+	if strings.HasPrefix(key, "/") {
+		return true
+	}
+	var resolved []string
+	for _, seg := range strings.Split(key, "/") {
+		switch seg {
+		case "", ".":
+		case "..":
+			if len(resolved) == 0 {
+				return true
+			}
+			resolved = resolved[:len(resolved)-1]
+		default:
+			resolved = append(resolved, seg)
+		}
+	}
+	return !strings.HasPrefix(strings.Join(resolved, "/"), prefix+"/")
+}
+
+func TestUploadRequestTraversalNameNotProbed(t *testing.T) {
+	id := testID("collides")
+	var (
+		mu    sync.Mutex
+		heads []string
+	)
+	// every key exists with the requested id, so any HeadObject of the
+	// computed key would turn into a 409 skip naming it
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			mu.Lock()
+			heads = append(heads, r.URL.Path)
+			mu.Unlock()
+			w.Header().Set("x-amz-meta-id", id)
+		}
+	}))
+	defer ts.Close()
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(ts.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	s := &server{
+		s3:    s3.New(sess),
+		clock: realClock{},
+		stats: newServerStats(time.Now()),
+	}
+	s.conf.Store(&ssmConfig{bucket: "bucket", pathPrefix: "photos/alice", timeFormat: defaultTimeFormat})
+
+	checks := []struct {
+		name      string
+		status    int
+		wantHeads bool
+	}{
+		{"IMG_0001.jpg", http.StatusConflict, true},
+		{"../../../../IMG_0001.jpg", http.StatusBadRequest, false},
+		{"../../../bob/IMG_0001.jpg", http.StatusBadRequest, false},
+	}
+	for _, check := range checks {
+		mu.Lock()
+		heads = nil
+		mu.Unlock()
+
+		body, _ := json.Marshal(FileMetadata{
+			ID:          id,
+			Name:        check.name,
+			Bytes:       10,
+			ContentType: "image/jpeg",
+			Mtime:       time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+			Version:     protocolVersion,
+		})
+		r := httptest.NewRequest("POST", "/upload_request", strings.NewReader(string(body)))
+		r.Header.Set("content-type", "application/json")
+		w := httptest.NewRecorder()
+		s.handleUploadRequest(w, r)
+
+		if w.Code != check.status {
+			t.Errorf("name %q: status = %d, want %d: %s", check.name, w.Code, check.status, w.Body.String())
+		}
+		mu.Lock()
+		if got := len(heads) > 0; got != check.wantHeads {
+			t.Errorf("name %q: HeadObject calls %v, want calls %t", check.name, heads, check.wantHeads)
+		}
+		mu.Unlock()
+		if check.status == http.StatusBadRequest {
+			var resp ErrorResponse
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.ErrorCode != errCodeInvalidName {
+				t.Errorf("name %q: error_code = %q, want %q", check.name, resp.ErrorCode, errCodeInvalidName)
+			}
+			if strings.Contains(w.Body.String(), "IMG_0001") {
+				t.Errorf("name %q: rejection leaks a key: %s", check.name, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestUploadExpiry(t *testing.T) {
+	s := &server{presignExpiry: 5 * time.Minute, presignMinBandwidth: 1 << 20}
+	checks := []struct {
+		size int64
+		want time.Duration
+	}{
+		{0, 5 * time.Minute},
+		{1 << 20, 5*time.Minute + time.Second},
+		{600 << 20, 15 * time.Minute},
+		{1 << 50, maxPresignExpiry},
+	}
+	for _, check := range checks {
+		if got := s.uploadExpiry(check.size); got != check.want {
+			t.Errorf("uploadExpiry(%d) = %s, want %s", check.size, got, check.want)
+		}
+	}
+
+	s.presignMinBandwidth = 0
+	if got := s.uploadExpiry(600 << 20); got != 5*time.Minute {
+		t.Errorf("uploadExpiry without a min bandwidth = %s, want the base expiry", got)
+	}
+}
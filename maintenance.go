@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/inconshreveable/log15"
+)
+
+// maintenanceTask is a one-shot maintenance job. The returned report is
+// logged (CLI) or returned as the invocation result (lambda).
+type maintenanceTask func(ctx context.Context) (interface{}, error)
+
+// maintenanceTasks maps a -mode name to a task. Each task can be run once
+// from the command line with -mode <name>, or as a scheduled lambda with
+// -mode lambda-<name>.
+func (s *server) maintenanceTasks() map[string]maintenanceTask {
+	return map[string]maintenanceTask{
+		"sweep-multipart":    s.sweepMultipartTask,
+		"verify-sample":      s.verifySampleTask,
+		"migrate-keys":       s.migrateKeysTask,
+		"sweep-inbox":        s.sweepInboxTask,
+		"sweep-test-uploads": s.sweepTestUploadsTask,
+	}
+}
+
+func runMaintenance(name string, task maintenanceTask) {
+	lgr := log15.New("task", name, "dry_run", *dryRun, "apply", *apply)
+	report, err := task(context.Background())
+	if err != nil {
+		lgr.Error("maintenance_err", "err", err)
+		os.Exit(1)
+	}
+	reportJSON, _ := json.Marshal(report)
+	lgr.Info("maintenance_done", "report", string(reportJSON))
+}
+
+func startMaintenanceLambda(name string, task maintenanceTask) {
+	lambda.Start(func(ctx context.Context) (interface{}, error) {
+		lgr := log15.New("task", name, "dry_run", *dryRun, "apply", *apply)
+		report, err := task(ctx)
+		if err != nil {
+			lgr.Error("maintenance_err", "err", err)
+			return nil, err
+		}
+		lgr.Info("maintenance_done")
+		return report, nil
+	})
+}
+
+// applying reports whether a task that deletes or rewrites stored objects
+// should make its changes. Those tasks default to reporting what they
+// would do and need -apply, which -dry-run overrides.
+func applying() bool {
+	return *apply && !*dryRun
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/inconshreveable/log15"
+)
+
+// MarkerDestination is a presigned PUT for the marker object of an upload.
+// The client writes Body to it once the upload succeeds.
+type MarkerDestination struct {
+	Key     string      `json:"key"`
+	URL     string      `json:"url"`
+	Method  string      `json:"method"`
+	Headers http.Header `json:"headers"`
+	Body    string      `json:"body"`
+}
+
+// markerBody is the JSON content of a marker object.
+type markerBody struct {
+	Bucket      string    `json:"bucket"`
+	Key         string    `json:"key"`
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Mtime       time.Time `json:"mtime"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	Device      string    `json:"device,omitempty"`
+	TestUpload  bool      `json:"test_upload"`
+}
+
+// presignMarker presigns the marker for an upload to bucket/key. The body
+// is fixed by its checksum, so the client can only write what the server
+// generated.
+func (s *server) presignMarker(lgr log15.Logger, conf *ssmConfig, bucket, key string, meta FileMetadata) (*MarkerDestination, error) {
+	body, err := json.Marshal(markerBody{
+		Bucket:      bucket,
+		Key:         key,
+		ID:          meta.ID,
+		Name:        meta.Name,
+		Mtime:       meta.Mtime,
+		Size:        meta.Bytes,
+		ContentType: meta.ContentType,
+		Device:      meta.Device,
+		TestUpload:  meta.TestUpload,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+
+	markerKey := path.Join(conf.markerPrefix, key) + ".json"
+	input := &s3.PutObjectInput{
+		Bucket:        &bucket,
+		Key:           &markerKey,
+		ContentLength: aws.Int64(int64(len(body))),
+		ContentType:   aws.String("application/json"),
+	}
+	signedHeaders := make(http.Header)
+	signedHeaders.Set("x-amz-checksum-sha256", base64.StdEncoding.EncodeToString(sum[:]))
+
+	url, err := s.presignPut(lgr, input, signedHeaders, postUploadExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	marker := &MarkerDestination{
+		Key:     markerKey,
+		URL:     url,
+		Method:  "PUT",
+		Headers: signedHeaders,
+		Body:    string(body),
+	}
+	marker.Headers.Set("content-length", strconv.Itoa(len(body)))
+	marker.Headers.Set("content-type", "application/json")
+	return marker, nil
+}
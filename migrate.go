@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/inconshreveable/log15"
+)
+
+type migrateReport struct {
+	Scanned         int `json:"scanned"`
+	Unchanged       int `json:"unchanged"`
+	Migrated        int `json:"migrated"`
+	AlreadyMigrated int `json:"already_migrated"`
+	Thumbnails      int `json:"thumbnails"`
+	Deleted         int `json:"deleted"`
+	Failed          int `json:"failed"`
+}
+
+// migrateKeysTask moves objects under pathPrefix to the key the current
+// config would give them, copying each one server side and, with
+// -migrate-delete-old, deleting the old key. Objects already at their new
+// key are left alone, so the task is safe to re-run after an interruption.
+// Nothing is copied or deleted without -apply.
+func (s *server) migrateKeysTask(ctx context.Context) (interface{}, error) {
+	conf := s.config()
+
+	var report migrateReport
+	for _, bucket := range conf.allBuckets() {
+		existing := make(map[string]bool)
+		var keys []string
+		err := s.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(conf.listPrefix()),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				key := aws.StringValue(obj.Key)
+				if !conf.storedKey(key) {
+					continue
+				}
+				existing[key] = true
+				// thumbnails are migrated with their original
+				if !strings.HasSuffix(key, thumbnailSuffix) {
+					keys = append(keys, key)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, oldKey := range keys {
+			report.Scanned++
+			lgr := log15.New("bucket", bucket, "old_key", oldKey)
+
+			newKey, err := s.migrateObject(ctx, conf, bucket, oldKey, &report, lgr)
+			if err != nil {
+				lgr.Error("migrate_err", "err", err)
+				report.Failed++
+				continue
+			}
+			if newKey == "" {
+				continue
+			}
+
+			if existing[oldKey+thumbnailSuffix] {
+				err = s.migrateThumbnail(ctx, bucket, oldKey, newKey, &report, lgr)
+				if err != nil {
+					lgr.Error("migrate_thumbnail_err", "err", err)
+					report.Failed++
+				}
+			}
+		}
+	}
+
+	return &report, nil
+}
+
+// migrateObject copies oldKey to its key under the current config. It
+// returns the new key, or "" if the object doesn't need to move.
+func (s *server) migrateObject(ctx context.Context, conf *ssmConfig, bucket, oldKey string, report *migrateReport, lgr log15.Logger) (string, error) {
+	head, err := s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &oldKey,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	meta, err := storedFileMetadata(head.Metadata, oldKey)
+	if err != nil {
+		return "", err
+	}
+	meta.ContentType = aws.StringValue(head.ContentType)
+	prefix := conf.typePrefix(conf.untypeDir(unshardDir(path.Dir(oldKey), meta.ID)), meta.ContentType)
+
+	var newKey string
+	for seq := 0; ; seq++ {
+		newKey, _ = s.objectKey(conf, prefix, meta, seq)
+		if newKey == oldKey {
+			report.Unchanged++
+			return "", nil
+		}
+
+		existing, err := s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    &newKey,
+		})
+		if isNotFound(err) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("head new key %s err: %w", newKey, err)
+		}
+		if metadataValue(existing.Metadata, "id") == meta.ID {
+			lgr.Info("migrate_already_copied", "new_key", newKey)
+			report.AlreadyMigrated++
+			return newKey, s.migrateDeleteOld(ctx, bucket, oldKey, report, lgr)
+		}
+		if seq >= maxKeyCollisions {
+			return "", fmt.Errorf("too many key collisions")
+		}
+	}
+	lgr = lgr.New("new_key", newKey)
+
+	if !applying() {
+		lgr.Info("migrate_would_copy")
+		report.Migrated++
+		return newKey, s.migrateDeleteOld(ctx, bucket, oldKey, report, lgr)
+	}
+
+	_, err = s.s3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:     &bucket,
+		Key:        &newKey,
+		CopySource: aws.String(copySource(bucket, oldKey)),
+	})
+	if err != nil {
+		return "", err
+	}
+	lgr.Info("migrate_copied")
+	report.Migrated++
+
+	return newKey, s.migrateDeleteOld(ctx, bucket, oldKey, report, lgr)
+}
+
+// migrateThumbnail moves the thumbnail of oldKey next to newKey, updating
+// its thumbnail-of metadata.
+func (s *server) migrateThumbnail(ctx context.Context, bucket, oldKey, newKey string, report *migrateReport, lgr log15.Logger) error {
+	oldThumb := oldKey + thumbnailSuffix
+	newThumb := newKey + thumbnailSuffix
+	lgr = lgr.New("old_thumbnail", oldThumb, "new_thumbnail", newThumb)
+
+	if !applying() {
+		lgr.Info("migrate_would_copy_thumbnail")
+		report.Thumbnails++
+		return s.migrateDeleteOld(ctx, bucket, oldThumb, report, lgr)
+	}
+
+	head, err := s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &oldThumb,
+	})
+	if err != nil {
+		return err
+	}
+	md := head.Metadata
+	for k := range md {
+		if strings.EqualFold(k, "thumbnail-of") {
+			delete(md, k)
+		}
+	}
+	md["thumbnail-of"] = aws.String(newKey)
+
+	_, err = s.s3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:            &bucket,
+		Key:               &newThumb,
+		CopySource:        aws.String(copySource(bucket, oldThumb)),
+		ContentType:       head.ContentType,
+		Metadata:          md,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	})
+	if err != nil {
+		return err
+	}
+	lgr.Info("migrate_copied_thumbnail")
+	report.Thumbnails++
+
+	return s.migrateDeleteOld(ctx, bucket, oldThumb, report, lgr)
+}
+
+func (s *server) migrateDeleteOld(ctx context.Context, bucket, key string, report *migrateReport, lgr log15.Logger) error {
+	if !*migrateDeleteOld {
+		return nil
+	}
+	if !applying() {
+		lgr.Info("migrate_would_delete", "key", key)
+		report.Deleted++
+		return nil
+	}
+	_, err := s.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return err
+	}
+	lgr.Info("migrate_deleted", "key", key)
+	report.Deleted++
+	return nil
+}
+
+// storedFileMetadata rebuilds the FileMetadata an object was uploaded
+// with from its stored metadata. Objects uploaded before the server
+// stored id metadata get the id from their key. The mtime metadata only
+// has second precision, so the time is parsed from the key's timestamp
+// with -migrate-from-time-format when possible.
+func storedFileMetadata(md map[string]*string, key string) (FileMetadata, error) {
+	meta := FileMetadata{
+		ID:   metadataValue(md, "id"),
+		Name: metadataValue(md, "filename"),
+	}
+	if meta.ID == "" {
+		meta.ID = idFromKey(key)
+	}
+	if meta.ID == "" || meta.Name == "" {
+		return meta, fmt.Errorf("object is missing id or filename metadata")
+	}
+
+	base := path.Base(key)
+	if i := strings.Index(base, "-"+meta.ID+"-"); i > 0 {
+		t, err := time.Parse(*migrateFromTimeFormat, base[:i])
+		if err == nil {
+			meta.Mtime = t
+			return meta, nil
+		}
+	}
+
+	t, err := time.Parse(time.RFC3339, metadataValue(md, "mtime"))
+	if err != nil {
+		return meta, fmt.Errorf("parse mtime metadata err: %w", err)
+	}
+	meta.Mtime = t
+	return meta, nil
+}
+
+// isNotFound reports whether err is a HeadObject of a key that doesn't
+// exist.
+func isNotFound(err error) bool {
+	var rerr awserr.RequestFailure
+	return errors.As(err, &rerr) && rerr.StatusCode() == http.StatusNotFound
+}
+
+// unshardDir strips the id shard segments, at any depth, from the end of
+// the directory of a key for id.
+func unshardDir(dir, id string) string {
+	for n := maxIDShardChars; n > 0; n -= 2 {
+		shard := idShardPath(id, n)
+		if dir == shard {
+			return "."
+		}
+		if strings.HasSuffix(dir, "/"+shard) {
+			return strings.TrimSuffix(dir, "/"+shard)
+		}
+	}
+	return dir
+}
+
+// copySource returns the url encoded CopySource for bucket/key.
+func copySource(bucket, key string) string {
+	return neturl.PathEscape(bucket) + "/" + strings.ReplaceAll(neturl.PathEscape(key), "%2F", "/")
+}
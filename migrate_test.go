@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestStoredFileMetadata(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	key := "photos/2021-06-01-12_00_00.5-" + id + "-IMG_0001.jpg"
+	keyTime := time.Date(2021, 6, 1, 12, 0, 0, 500000000, time.UTC)
+
+	tests := []struct {
+		name    string
+		md      map[string]*string
+		key     string
+		wantID  string
+		wantErr bool
+	}{
+		{
+			name: "id metadata",
+			md: map[string]*string{
+				"Id":       aws.String(id),
+				"Filename": aws.String("IMG_0001.jpg"),
+			},
+			key:    key,
+			wantID: id,
+		},
+		{
+			// uploaded before the server stored id metadata
+			name: "id from key",
+			md: map[string]*string{
+				"Filename": aws.String("IMG_0001.jpg"),
+				"Mtime":    aws.String("2021-06-01T12:00:00Z"),
+			},
+			key:    key,
+			wantID: id,
+		},
+		{
+			name: "no id anywhere",
+			md: map[string]*string{
+				"Filename": aws.String("IMG_0001.jpg"),
+				"Mtime":    aws.String("2021-06-01T12:00:00Z"),
+			},
+			key:     "photos/IMG_0001.jpg",
+			wantErr: true,
+		},
+		{
+			name:    "no filename",
+			md:      map[string]*string{"Id": aws.String(id)},
+			key:     key,
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		meta, err := storedFileMetadata(tc.md, tc.key)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", tc.name, meta)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if meta.ID != tc.wantID || meta.Name != "IMG_0001.jpg" || !meta.Mtime.Equal(keyTime) {
+			t.Errorf("%s: got %+v", tc.name, meta)
+		}
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	notFound := awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "req")
+	forbidden := awserr.NewRequestFailure(awserr.New("Forbidden", "Forbidden", nil), http.StatusForbidden, "req")
+
+	if !isNotFound(notFound) {
+		t.Error("404 should be not found")
+	}
+	if isNotFound(forbidden) || isNotFound(errors.New("connection reset")) || isNotFound(nil) {
+		t.Error("only a 404 should be not found")
+	}
+}
+
+func TestMigrateKeysApply(t *testing.T) {
+	defer func(a, d, del bool) { *apply, *dryRun, *migrateDeleteOld = a, d, del }(*apply, *dryRun, *migrateDeleteOld)
+	*migrateDeleteOld = true
+
+	const id = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	oldKey := "photos/2021-06-01-12_00_00.5-" + id + "-IMG_0001.jpg"
+
+	checks := []struct {
+		name       string
+		apply, dry bool
+		wantWrites []string
+	}{
+		{"default", false, false, nil},
+		{"dry run", false, true, nil},
+		{"apply", true, false, []string{"PUT", "DELETE"}},
+		{"apply and dry run", true, true, nil},
+	}
+	for _, check := range checks {
+		t.Run(check.name, func(t *testing.T) {
+			*apply, *dryRun = check.apply, check.dry
+
+			var (
+				mu     sync.Mutex
+				writes []string
+			)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == "GET":
+					fmt.Fprintf(w, `<ListBucketResult><Contents><Key>%s</Key></Contents></ListBucketResult>`, oldKey)
+				case r.Method == "HEAD" && r.URL.Path == "/bucket/"+oldKey:
+					w.Header().Set("x-amz-meta-id", id)
+					w.Header().Set("x-amz-meta-filename", "IMG_0001.jpg")
+				case r.Method == "HEAD":
+					w.WriteHeader(http.StatusNotFound)
+				default:
+					mu.Lock()
+					writes = append(writes, r.Method)
+					mu.Unlock()
+					if r.Method == "PUT" {
+						fmt.Fprint(w, `<CopyObjectResult></CopyObjectResult>`)
+					} else {
+						w.WriteHeader(http.StatusNoContent)
+					}
+				}
+			}))
+			defer ts.Close()
+			sess := session.Must(session.NewSession(&aws.Config{
+				Endpoint:         aws.String(ts.URL),
+				Region:           aws.String("us-east-1"),
+				Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+				S3ForcePathStyle: aws.Bool(true),
+			}))
+
+			s := &server{s3: s3.New(sess)}
+			s.conf.Store(&ssmConfig{bucket: "bucket", pathPrefix: "photos", timeFormat: defaultTimeFormat, idShardChars: 2})
+
+			out, err := s.migrateKeysTask(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			report := out.(*migrateReport)
+			if report.Migrated != 1 || report.Deleted != 1 || report.Failed != 0 {
+				t.Errorf("report = %+v, want 1 migrated and deleted", report)
+			}
+			if fmt.Sprint(writes) != fmt.Sprint(check.wantWrites) {
+				t.Errorf("writes = %v, want %v", writes, check.wantWrites)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// parseCutoff parses an -exclude-older-than value: either a duration
+// before now or a date (2006-01-02, or RFC 3339 for a time of day). An
+// empty value returns the zero time, which disables the filter.
+func parseCutoff(raw string, now time.Time) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", raw, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid -exclude-older-than %q, expected a positive duration or a date (2006-01-02)", raw)
+}
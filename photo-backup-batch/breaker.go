@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
+// upstreamError marks an error talking to the server or s3, as opposed to
+// a local problem with the file.
+type upstreamError struct {
+	err error
+}
+
+func (e upstreamError) Error() string { return e.err.Error() }
+func (e upstreamError) Unwrap() error { return e.err }
+
+func isUpstreamErr(err error) bool {
+	var uerr upstreamError
+	return errors.As(err, &uerr)
+}
+
+// circuitBreaker pauses the run after maxFailures consecutive upstream
+// failures, doubling the pause each time, and gives up after maxPauses
+// pauses without a success in between.
+type circuitBreaker struct {
+	maxFailures int
+	maxPauses   int
+	backoff     time.Duration
+
+	failures int
+	pauses   int
+	pause    time.Duration
+}
+
+func (b *circuitBreaker) success() {
+	b.failures = 0
+	b.pauses = 0
+	b.pause = 0
+}
+
+// failure records an upstream failure. It returns an error once the
+// upstream appears to be down and the run should stop.
+func (b *circuitBreaker) failure(err error) error {
+	b.failures++
+	if b.failures < b.maxFailures {
+		return nil
+	}
+
+	if b.pauses >= b.maxPauses {
+		return fmt.Errorf("upstream appears down: %d consecutive failures after %d pauses, last err: %w", b.failures, b.pauses, err)
+	}
+
+	if b.pause == 0 {
+		b.pause = b.backoff
+	} else {
+		b.pause *= 2
+	}
+	b.pauses++
+	b.failures = 0
+	log15.Warn("circuit_breaker_pause", "pause", b.pause, "pauses", b.pauses, "max_pauses", b.maxPauses, "err", err)
+	time.Sleep(b.pause)
+	return nil
+}
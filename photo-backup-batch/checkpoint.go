@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// checkpoint records how far through the pending dir a batch run got, so an
+// interrupted run can fast-forward past files it already processed.
+// os.ReadDir returns entries sorted by name, so the last processed name is
+// enough to resume.
+type checkpoint struct {
+	PendingDir string `json:"pending_dir"`
+	LastName   string `json:"last_name"`
+	Processed  int    `json:"processed"`
+}
+
+func loadCheckpoint(path string) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &checkpoint{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var cp checkpoint
+	err = json.Unmarshal(data, &cp)
+	if err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+func (cp *checkpoint) save(path string) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to path by writing to a temp file in the
+// same directory and renaming it over the old one.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
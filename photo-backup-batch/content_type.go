@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// contentTypeOverrides maps a lowercase file extension (including the
+// leading dot) to the content-type to use instead of the detected one.
+type contentTypeOverrides map[string]string
+
+// loadContentTypeOverrides reads a JSON object mapping extensions to
+// content-types, e.g. {".heic": "image/heic"}.
+func loadContentTypeOverrides(path string) (contentTypeOverrides, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]string
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s err: %w", path, err)
+	}
+
+	overrides := make(contentTypeOverrides)
+	for ext, contentType := range raw {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		overrides[ext] = contentType
+	}
+	return overrides, nil
+}
+
+func (o contentTypeOverrides) lookup(name string) (string, bool) {
+	contentType, ok := o[strings.ToLower(filepath.Ext(name))]
+	return contentType, ok
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/photo-backup-lambda/client"
+)
+
+// isMediaType reports whether contentType passes the media gate, which
+// allowAll (-allow-all-types) turns off.
+func isMediaType(contentType string, allowAll bool) bool {
+	if allowAll {
+		return true
+	}
+	contentParts := strings.SplitN(contentType, "/", 2)
+	switch contentParts[0] {
+	case "image", "audio", "video":
+		return true
+	}
+	return false
+}
+
+type extReport struct {
+	count        int
+	skipped      int
+	contentTypes map[string]int
+}
+
+// discoverTypes scans src and reports the distinct file extensions and
+// detected content-types found, flagging which would be skipped by the
+// media gate. It does not upload anything.
+func discoverTypes(src source, files []string, overrides contentTypeOverrides) error {
+	reports := make(map[string]*extReport)
+
+	for _, fname := range files {
+		contentType, err := func() (string, error) {
+			f, err := src.open(fname)
+			if err != nil {
+				return "", err
+			}
+			defer f.Close()
+			return client.DetectContentType(f)
+		}()
+		if err != nil {
+			return err
+		}
+		if override, ok := overrides.lookup(fname); ok {
+			contentType = override
+		}
+
+		ext := strings.ToLower(path.Ext(fname))
+		r := reports[ext]
+		if r == nil {
+			r = &extReport{contentTypes: make(map[string]int)}
+			reports[ext] = r
+		}
+		r.count++
+		r.contentTypes[contentType]++
+		if !isMediaType(contentType, *allowAllTypes) {
+			r.skipped++
+		}
+	}
+
+	exts := make([]string, 0, len(reports))
+	for ext := range reports {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+
+	for _, ext := range exts {
+		r := reports[ext]
+		contentTypes := make([]string, 0, len(r.contentTypes))
+		for ct := range r.contentTypes {
+			contentTypes = append(contentTypes, ct)
+		}
+		sort.Strings(contentTypes)
+
+		lgr := log15.New("ext", ext, "count", r.count, "content_types", strings.Join(contentTypes, ","))
+		if r.skipped > 0 {
+			lgr.Warn("discover_ext_would_skip", "skipped", r.skipped)
+		} else {
+			lgr.Info("discover_ext")
+		}
+	}
+
+	return nil
+}
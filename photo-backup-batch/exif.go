@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+type timeSource string
+
+var (
+	timeSourceEXIF timeSource = "exif"
+	timeSourceFS   timeSource = "fs"
+)
+
+// captureTime returns the EXIF capture time of r. If it can't be read,
+// fsMtime is returned along with the reason for the fallback.
+func captureTime(r io.ReadSeeker, fsMtime time.Time) (time.Time, timeSource, error) {
+	_, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		return fsMtime, timeSourceFS, err
+	}
+
+	x, err := exif.Decode(r)
+	if err != nil {
+		return fsMtime, timeSourceFS, err
+	}
+
+	t, err := x.DateTime()
+	if err != nil {
+		return fsMtime, timeSourceFS, err
+	}
+	if t.IsZero() {
+		return fsMtime, timeSourceFS, errors.New("zero exif datetime")
+	}
+
+	return t, timeSourceEXIF, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// loadRetryList reads a -failures-out file: one path relative to
+// pending_dir per line.
+func loadRetryList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var names []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" || strings.HasPrefix(name, "#") || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// writeFailures writes the paths of the files a run left behind, with
+// their sidecars so -retry-from can match them up again. A run without
+// failures writes an empty file.
+func writeFailures(path string, names []string, sidecarFor map[string]string) error {
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name + "\n")
+		if sc := sidecarFor[name]; sc != "" {
+			sb.WriteString(sc + "\n")
+		}
+	}
+	return os.WriteFile(path, []byte(sb.String()), 0644)
+}
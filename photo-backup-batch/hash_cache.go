@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/photo-backup-lambda/client"
+	"github.com/psanford/photo-backup-lambda/internal/clitool"
+)
+
+type hashCacheEntry struct {
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+	ID    string    `json:"id"`
+}
+
+// hashCache maps an absolute file path to its id. An entry is only valid
+// while the file's size and mtime are unchanged.
+type hashCache map[string]hashCacheEntry
+
+func loadHashCache(path string) (hashCache, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return make(hashCache), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var c hashCache
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s err: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c hashCache) save(path string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func (c hashCache) lookup(path string, size int64, mtime time.Time) (string, bool) {
+	e, ok := c[path]
+	if !ok || e.Size != size || !e.Mtime.Equal(mtime) {
+		return "", false
+	}
+	return e.ID, true
+}
+
+// runHash implements the hash subcommand: it walks a directory, computes
+// the id of every file whose cache entry is missing or stale, and writes
+// the cache for later upload runs to read with -hash-cache.
+func runHash(args []string) error {
+	flags := flag.NewFlagSet("hash", flag.ExitOnError)
+	dir := flags.String("dir", "", "Directory to hash (recursively)")
+	cachePath := flags.String("cache", "", "Path of the hash cache file to create or update")
+	parallel := flags.Int("parallel", runtime.NumCPU(), "Number of files to hash at once")
+	flags.Parse(args)
+
+	if *dir == "" || *cachePath == "" {
+		return fmt.Errorf("hash: -dir and -cache are required")
+	}
+	workers := capParallelism(*parallel)
+	absDir, err := filepath.Abs(*dir)
+	if err != nil {
+		return err
+	}
+
+	cache, err := loadHashCache(*cachePath)
+	if err != nil {
+		return err
+	}
+
+	type job struct {
+		path string
+		info os.FileInfo
+	}
+	var todo []job
+	err = filepath.WalkDir(absDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if _, ok := cache.lookup(path, info.Size(), info.ModTime()); !ok {
+			todo = append(todo, job{path, info})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log15.Info("hash_start", "dir", absDir, "to_hash", len(todo), "cached", len(cache))
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		jobs     = make(chan job)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				id, err := hashFile(j.path)
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					cache[j.path] = hashCacheEntry{
+						Size:  j.info.Size(),
+						Mtime: j.info.ModTime(),
+						ID:    id,
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, j := range todo {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	err = cache.save(*cachePath)
+	if err != nil {
+		return err
+	}
+	log15.Info("hash_done", "hashed", len(todo), "entries", len(cache))
+	return nil
+}
+
+// fdReserve is the number of file descriptors kept free for everything
+// other than the files being hashed: stdio, the cache file, logging and
+// any http connections.
+const fdReserve = 64
+
+// capParallelism limits the number of files open at once so each worker
+// can hold one without running into the process's open file limit.
+func capParallelism(requested int) int {
+	limit, err := clitool.OpenFileLimit()
+	if err != nil {
+		log15.Debug("open_file_limit_err", "err", err)
+		return requested
+	}
+	if requested < 1 || uint64(requested)+fdReserve <= limit {
+		return requested
+	}
+	max := 1
+	if limit > fdReserve+1 {
+		max = int(limit - fdReserve)
+	}
+	log15.Warn("parallelism_capped_by_open_file_limit", "requested", requested, "parallel", max, "open_file_limit", limit)
+	return max
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	return client.ComputeID(withHashProgress(f, path, fi.Size()))
+}
+
+// fileID returns the id and sniffed content-type of f. The id comes from
+// ids if it lists name, or from hashes if it has a current entry for a
+// local file; otherwise both are computed in one pass over the file.
+func fileID(src source, name string, f sourceFile, ids map[string]string, hashes hashCache) (string, string, error) {
+	if id, ok := ids[name]; ok {
+		// the upload's checksum header makes s3 reject the file if the
+		// supplied id is wrong
+		contentType, err := client.DetectContentType(f)
+		return id, contentType, err
+	}
+	if ls, ok := src.(*localSource); ok && hashes != nil {
+		path, err := filepath.Abs(filepath.Join(ls.pendingDir, name))
+		if err != nil {
+			return "", "", err
+		}
+		if id, ok := hashes.lookup(path, f.Size(), f.ModTime()); ok {
+			contentType, err := client.DetectContentType(f)
+			return id, contentType, err
+		}
+	}
+	return client.ComputeIDAndContentType(withHashProgress(f, name, f.Size()))
+}
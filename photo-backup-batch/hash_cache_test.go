@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// BenchmarkFileID measures the per-file open, hash and sniff path of a
+// batch run over a synthetic pending dir.
+func BenchmarkFileID(b *testing.B) {
+	const (
+		numFiles = 200
+		fileSize = 200 << 10
+	)
+	dir := b.TempDir()
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, fileSize)
+	names := make([]string, numFiles)
+	for i := range names {
+		rnd.Read(data)
+		names[i] = fmt.Sprintf("IMG_%04d.jpg", i)
+		err := os.WriteFile(filepath.Join(dir, names[i]), data, 0600)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	src := &localSource{pendingDir: dir}
+
+	b.SetBytes(numFiles * fileSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		for _, name := range names {
+			f, err := src.open(name)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, _, err = fileID(src, name, f, nil, nil)
+			f.Close()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(numFiles*b.N)/time.Since(start).Seconds(), "files/s")
+}
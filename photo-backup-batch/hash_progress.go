@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/inconshreveable/log15"
+)
+
+// hashProgressInterval is how often hashing a large file logs progress.
+const hashProgressInterval = 5 * time.Second
+
+// hashProgressReader logs how much of a file has been hashed every
+// hashProgressInterval, so hashing a multi-gigabyte video doesn't look
+// like a hang.
+type hashProgressReader struct {
+	r     io.Reader
+	name  string
+	total int64
+	read  int64
+	start time.Time
+	last  time.Time
+}
+
+// withHashProgress wraps r to log progress if the file is at least
+// -hash-progress-size bytes.
+func withHashProgress(r io.Reader, name string, size int64) io.Reader {
+	if *hashProgressSize <= 0 || size < *hashProgressSize {
+		return r
+	}
+	now := time.Now()
+	return &hashProgressReader{r: r, name: name, total: size, start: now, last: now}
+}
+
+func (p *hashProgressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= hashProgressInterval {
+		p.last = now
+		log15.Info("hash_progress", "name", p.name, "bytes", p.read, "total", p.total,
+			"pct", p.read*100/p.total, "elapsed", now.Sub(p.start).Round(time.Second))
+	}
+	if err == io.EOF && p.last != p.start {
+		log15.Info("hash_done", "name", p.name, "bytes", p.read, "elapsed", time.Since(p.start).Round(time.Second))
+	}
+	return n, err
+}
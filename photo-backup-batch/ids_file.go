@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/psanford/photo-backup-lambda/client"
+)
+
+// loadIDsFile reads precomputed ids in sha256sum output format
+// ("<hex sum>  <name>", with an optional "*" before the name for binary
+// mode), keyed by name relative to pending_dir.
+func loadIDsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ids := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<sha256>  <name>\"", path, lineNo)
+		}
+		id, err := client.ParseID(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		name := strings.TrimPrefix(strings.TrimLeft(parts[1], " "), "*")
+		ids[strings.TrimPrefix(name, "./")] = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/photo-backup-lambda/client"
+)
+
+type knownIDsCache struct {
+	FetchedAt time.Time `json:"fetched_at"`
+	IDs       []string  `json:"ids"`
+}
+
+// loadKnownIDs returns the set of ids the server already has. If cachePath
+// holds a cache younger than ttl it is used, otherwise the ids are fetched
+// from the server and the cache is rewritten.
+func loadKnownIDs(ctx context.Context, c *client.Client, cachePath string, ttl time.Duration) (map[string]bool, error) {
+	if cachePath != "" {
+		data, err := os.ReadFile(cachePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			var cache knownIDsCache
+			err = json.Unmarshal(data, &cache)
+			if err != nil {
+				log15.Warn("known_ids_cache_corrupt", "path", cachePath, "err", err)
+			} else if time.Since(cache.FetchedAt) < ttl {
+				ids := make(map[string]bool, len(cache.IDs))
+				for _, id := range cache.IDs {
+					ids[id] = true
+				}
+				log15.Info("known_ids_from_cache", "count", len(ids), "age", time.Since(cache.FetchedAt).Round(time.Second))
+				return ids, nil
+			}
+		}
+	}
+
+	ids, err := c.KnownIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log15.Info("known_ids_fetched", "count", len(ids))
+
+	if cachePath != "" {
+		cache := knownIDsCache{
+			FetchedAt: time.Now(),
+			IDs:       make([]string, 0, len(ids)),
+		}
+		for id := range ids {
+			cache.IDs = append(cache.IDs, id)
+		}
+		data, err := json.Marshal(cache)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(cachePath, data, 0600)
+		if err != nil {
+			log15.Warn("known_ids_cache_write_err", "path", cachePath, "err", err)
+		}
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/photo-backup-lambda/client"
+)
+
+// doneChecker is the part of the client listDone needs.
+type doneChecker interface {
+	KnownObjects(ctx context.Context) (map[string]bool, []string, error)
+	DownloadURLs(ctx context.Context, keys []string) (*client.DownloadBatchResponse, error)
+	OpenDownload(ctx context.Context, url string) (io.ReadCloser, error)
+	RequestUploadURL(ctx context.Context, meta client.FileMetadata) (*client.UploadDestination, error)
+}
+
+// listDone checks every media file in doneDir against the server without
+// uploading anything, and reports the ones the server doesn't have. A
+// file in doneDir that isn't in the bucket means it was moved to done
+// without a real upload.
+func listDone(ctx context.Context, c doneChecker, doneDir string, overrides contentTypeOverrides, album string) error {
+	present, missing, err := checkDone(ctx, c, doneDir, overrides, album)
+	if err != nil {
+		return err
+	}
+	log15.Info("list_done_summary", "present", present, "missing", missing)
+	if missing > 0 {
+		return fmt.Errorf("%d files in %s are missing from the bucket", missing, doneDir)
+	}
+	return nil
+}
+
+// checkDone counts the media files in doneDir the server has and doesn't
+// have. Files are matched by id against the server's known ids, which
+// covers every album, and the ids listed in the manifests of its packs.
+// The rest are checked with a validate only request for album, which
+// also reports the key the file would have.
+func checkDone(ctx context.Context, c doneChecker, doneDir string, overrides contentTypeOverrides, album string) (present, missing int, err error) {
+	src := &localSource{pendingDir: doneDir}
+	files, err := src.list()
+	if err != nil {
+		return 0, 0, err
+	}
+	known, packs, err := c.KnownObjects(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("fetch known ids err: %w", err)
+	}
+	err = addPackedIDs(ctx, c, packs, known)
+	if err != nil {
+		return 0, 0, fmt.Errorf("read pack manifests err: %w", err)
+	}
+
+	for _, fname := range files {
+		dest, err := func() (*client.UploadDestination, error) {
+			f, err := src.open(fname)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+
+			id, err := client.ComputeID(f)
+			if err != nil {
+				return nil, err
+			}
+			contentType, err := client.DetectContentType(f)
+			if err != nil {
+				return nil, err
+			}
+			if override, ok := overrides.lookup(fname); ok {
+				contentType = override
+			}
+			if !isMediaType(contentType, *allowAllTypes) {
+				return nil, nil
+			}
+			if known[id] {
+				return &client.UploadDestination{Status: client.StatusSkipUpload}, nil
+			}
+
+			mtime := f.ModTime()
+			if *exifTime {
+				mtime, _, _ = captureTime(f, mtime)
+			}
+
+			return c.RequestUploadURL(ctx, client.FileMetadata{
+				ID:           id,
+				Name:         path.Base(fname),
+				Mtime:        mtime,
+				Bytes:        f.Size(),
+				ContentType:  contentType,
+				Album:        album,
+				ValidateOnly: true,
+			})
+		}()
+		if err != nil {
+			return present, missing, err
+		}
+		if dest == nil {
+			continue
+		}
+
+		if dest.Status == client.StatusSkipUpload {
+			log15.Debug("done_file_present", "name", fname, "key", dest.Key)
+			present++
+			continue
+		}
+		log15.Warn("done_file_missing_from_bucket", "name", fname, "expected_key", dest.Key)
+		missing++
+	}
+	return present, missing, nil
+}
+
+// addPackedIDs adds the ids of the files in each pack to known. Only the
+// manifest at the start of each pack is downloaded.
+func addPackedIDs(ctx context.Context, c doneChecker, packs []string, known map[string]bool) error {
+	for len(packs) > 0 {
+		batch := packs
+		if len(batch) > client.MaxDownloadBatch {
+			batch = batch[:client.MaxDownloadBatch]
+		}
+		packs = packs[len(batch):]
+
+		resp, err := c.DownloadURLs(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for _, u := range resp.URLs {
+			entries, err := func() ([]packEntry, error) {
+				body, err := c.OpenDownload(ctx, u.URL)
+				if err != nil {
+					return nil, err
+				}
+				defer body.Close()
+				return readPackManifest(body)
+			}()
+			if err != nil {
+				// its files are reported missing
+				log15.Warn("pack_manifest_err", "key", u.Key, "err", err)
+				continue
+			}
+			for _, e := range entries {
+				known[e.ID] = true
+			}
+		}
+	}
+	return nil
+}
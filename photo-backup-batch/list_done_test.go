@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/psanford/photo-backup-lambda/client"
+)
+
+// fakeServer has files stored under albums, keyed like the server does
+// with the album as a sub-prefix.
+type fakeServer struct {
+	known  map[string]bool
+	stored map[string]bool   // album/id
+	packs  map[string][]byte // key to tar
+}
+
+func (s *fakeServer) KnownObjects(ctx context.Context) (map[string]bool, []string, error) {
+	known := make(map[string]bool)
+	for id := range s.known {
+		known[id] = true
+	}
+	var packs []string
+	for key := range s.packs {
+		packs = append(packs, key)
+	}
+	return known, packs, nil
+}
+
+func (s *fakeServer) DownloadURLs(ctx context.Context, keys []string) (*client.DownloadBatchResponse, error) {
+	resp := &client.DownloadBatchResponse{Status: client.StatusOK}
+	for _, key := range keys {
+		resp.URLs = append(resp.URLs, client.DownloadURL{Key: key, URL: "https://s3.example/" + key})
+	}
+	return resp, nil
+}
+
+func (s *fakeServer) OpenDownload(ctx context.Context, url string) (io.ReadCloser, error) {
+	data, ok := s.packs[strings.TrimPrefix(url, "https://s3.example/")]
+	if !ok {
+		return nil, errors.New("GET download: status 404")
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *fakeServer) RequestUploadURL(ctx context.Context, meta client.FileMetadata) (*client.UploadDestination, error) {
+	key := path.Join("photos", meta.Album, meta.ID+"-"+meta.Name)
+	if s.stored[path.Join(meta.Album, meta.ID)] {
+		return &client.UploadDestination{Status: client.StatusSkipUpload, Key: key}, nil
+	}
+	return &client.UploadDestination{Status: client.StatusOK, Key: key}, nil
+}
+
+func writeDoneFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(dir, name), data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := client.ComputeID(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestCheckDoneAlbum(t *testing.T) {
+	dir := t.TempDir()
+	tripID := writeDoneFile(t, dir, "trip.jpg", []byte("\xff\xd8\xff\xe0 trip"))
+	otherID := writeDoneFile(t, dir, "other.jpg", []byte("\xff\xd8\xff\xe0 other album"))
+	writeDoneFile(t, dir, "lost.jpg", []byte("\xff\xd8\xff\xe0 never uploaded"))
+	writeDoneFile(t, dir, "notes.txt", []byte("not media"))
+
+	srv := &fakeServer{
+		// the ids listing covers every album
+		known: map[string]bool{otherID: true},
+		stored: map[string]bool{
+			path.Join("trips", tripID):   true,
+			path.Join("family", otherID): true,
+		},
+	}
+
+	tests := []struct {
+		album       string
+		wantPresent int
+		wantMissing int
+	}{
+		{album: "trips", wantPresent: 2, wantMissing: 1},
+		// without the album the validate only request looks in the
+		// wrong prefix, so only the id match finds other.jpg
+		{album: "", wantPresent: 1, wantMissing: 2},
+	}
+	for _, tc := range tests {
+		present, missing, err := checkDone(context.Background(), srv, dir, nil, tc.album)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if present != tc.wantPresent || missing != tc.wantMissing {
+			t.Errorf("album %q: present=%d missing=%d, want present=%d missing=%d", tc.album, present, missing, tc.wantPresent, tc.wantMissing)
+		}
+	}
+}
+
+func TestCheckDonePacks(t *testing.T) {
+	dir := t.TempDir()
+	var p packer
+	for _, name := range []string{"clip1.jpg", "clip2.jpg"} {
+		data := []byte("\xff\xd8\xff\xe0 " + name)
+		id := writeDoneFile(t, dir, name, data)
+		err := p.add(memFile{bytes.NewReader(data)}, name, "", client.FileMetadata{ID: id, Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeDoneFile(t, dir, "lost.jpg", []byte("\xff\xd8\xff\xe0 never uploaded"))
+
+	pack, _, err := p.build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &fakeServer{
+		packs: map[string][]byte{
+			"photos/2021-06-01-12_00_00-aaaa-pack.tar": pack,
+			// unreadable packs are skipped, not fatal
+			"photos/2021-06-01-12_00_00-bbbb-pack.tar": []byte("not a tar"),
+		},
+	}
+
+	present, missing, err := checkDone(context.Background(), srv, dir, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if present != 2 || missing != 1 {
+		t.Errorf("present=%d missing=%d, want present=2 missing=1", present, missing)
+	}
+}
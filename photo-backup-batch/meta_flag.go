@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// metaFlag collects repeated -meta key=value flags.
+type metaFlag map[string]string
+
+func (m metaFlag) String() string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m metaFlag) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	m[strings.ToLower(kv[0])] = kv[1]
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// capturedTime is a file's capture time as computed by captureTime.
+type capturedTime struct {
+	t      time.Time
+	source timeSource
+	reason error // why the EXIF time wasn't used, if it wasn't
+}
+
+// orderFiles sorts files for upload. "name" keeps the listing order;
+// "mtime" uploads the oldest files first; "exif-time" uploads the oldest
+// captures first, falling back to the mtime for files without EXIF. For
+// exif-time the computed capture times are returned so the upload pass
+// doesn't have to read them again.
+func orderFiles(src source, files []string, order string) ([]string, map[string]capturedTime, error) {
+	switch order {
+	case "name":
+		return files, nil, nil
+	case "mtime", "exif-time":
+	default:
+		return nil, nil, fmt.Errorf("invalid -order %q, expected name, mtime or exif-time", order)
+	}
+
+	var captured map[string]capturedTime
+	if order == "exif-time" {
+		captured = make(map[string]capturedTime, len(files))
+	}
+
+	times := make(map[string]time.Time, len(files))
+	for _, fname := range files {
+		f, err := src.open(fname)
+		if err != nil {
+			return nil, nil, err
+		}
+		times[fname] = f.ModTime()
+		if captured != nil {
+			var ct capturedTime
+			ct.t, ct.source, ct.reason = captureTime(f, f.ModTime())
+			captured[fname] = ct
+			times[fname] = ct.t
+		}
+		f.Close()
+	}
+
+	sorted := append([]string(nil), files...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return times[sorted[i]].Before(times[sorted[j]])
+	})
+	return sorted, captured, nil
+}
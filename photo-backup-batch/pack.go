@@ -0,0 +1,219 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/photo-backup-lambda/client"
+)
+
+// packManifestName is the first entry of every pack. It lists the packed
+// files in the order they appear in the tar, so a reader only needs the
+// start of the object to find out what's in it.
+const packManifestName = "manifest.json"
+
+// packEntry is one file's row in a pack manifest.
+type packEntry struct {
+	Path        string            `json:"path"`
+	Name        string            `json:"name"`
+	ID          string            `json:"id"`
+	Size        int64             `json:"size"`
+	Mtime       time.Time         `json:"mtime"`
+	ContentType string            `json:"content_type"`
+	Extra       map[string]string `json:"extra,omitempty"`
+}
+
+type packFile struct {
+	entry   packEntry
+	sidecar string
+	data    []byte
+}
+
+// packer collects small files and uploads them together as a single tar
+// object once maxBytes of file data has been added. Files are only moved
+// to done once the pack containing them has been stored.
+type packer struct {
+	maxBytes int64
+	files    []packFile
+	size     int64
+
+	// the flag values flush uses, so tests can set them per run
+	testUpload  bool
+	device      string
+	album       string
+	expireAfter time.Duration
+	extraMeta   map[string]string
+	moveOnSkip  bool
+}
+
+func (p *packer) add(f sourceFile, fname, sidecar string, meta client.FileMetadata) error {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	p.files = append(p.files, packFile{
+		entry: packEntry{
+			Path:        fname,
+			Name:        meta.Name,
+			ID:          meta.ID,
+			Size:        int64(len(data)),
+			Mtime:       meta.Mtime,
+			ContentType: meta.ContentType,
+			Extra:       meta.Extra,
+		},
+		sidecar: sidecar,
+		data:    data,
+	})
+	p.size += int64(len(data))
+	return nil
+}
+
+func (p *packer) full() bool {
+	return p.size >= p.maxBytes
+}
+
+// build writes the tar for the pending files. The output only depends on
+// the manifest and file contents, so packing the same files again gives
+// the same id and the server skips it.
+func (p *packer) build() ([]byte, time.Time, error) {
+	manifest := make([]packEntry, len(p.files))
+	var newest time.Time
+	for i, pf := range p.files {
+		manifest[i] = pf.entry
+		if pf.entry.Mtime.After(newest) {
+			newest = pf.entry.Mtime
+		}
+	}
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, newest, err
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	write := func(name string, mtime time.Time, data []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: mtime,
+			Format:  tar.FormatPAX,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	}
+
+	err = write(packManifestName, newest, manifestData)
+	if err != nil {
+		return nil, newest, err
+	}
+	for _, pf := range p.files {
+		err = write(pf.entry.Path, pf.entry.Mtime, pf.data)
+		if err != nil {
+			return nil, newest, err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return nil, newest, err
+	}
+	return buf.Bytes(), newest, nil
+}
+
+// readPackManifest reads the manifest from the start of a pack, without
+// reading the packed files.
+func readPackManifest(r io.Reader) ([]packEntry, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name != packManifestName {
+		return nil, fmt.Errorf("pack starts with %s, not %s", hdr.Name, packManifestName)
+	}
+	var entries []packEntry
+	err = json.NewDecoder(tr).Decode(&entries)
+	return entries, err
+}
+
+// flush uploads the pending files as one pack and moves them to done.
+func (p *packer) flush(ctx context.Context, c uploader, src source, stats *runStats, manifest *runManifest) error {
+	if len(p.files) == 0 {
+		return nil
+	}
+
+	data, mtime, err := p.build()
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+
+	meta := client.FileMetadata{
+		ID:          hex.EncodeToString(sum[:]),
+		Name:        "pack.tar",
+		Mtime:       mtime,
+		Bytes:       int64(len(data)),
+		ContentType: "application/x-tar",
+		TestUpload:  p.testUpload,
+		Device:      p.device,
+		Album:       p.album,
+		Extra: map[string]string{
+			"pack-files": strconv.Itoa(len(p.files)),
+		},
+	}
+	if p.expireAfter > 0 {
+		meta.ExpireAfter = p.expireAfter.String()
+	}
+	for k, v := range p.extraMeta {
+		meta.Extra[k] = v
+	}
+
+	lgr := log15.New("id", meta.ID, "files", len(p.files), "bytes", len(data))
+	dest, err := c.Upload(ctx, bytes.NewReader(data), meta)
+	if err != nil {
+		return upstreamError{err}
+	}
+	if dest.Status == client.StatusSkipUpload {
+		lgr.Info("pack_already_exists", "key", dest.Key)
+		stats.skipped += len(p.files)
+	} else {
+		lgr.Info("pack_upload_success", "key", dest.Key)
+		stats.uploaded += len(p.files)
+	}
+	stats.packs++
+
+	for _, pf := range p.files {
+		manifest.add(pf.entry.Path, pf.entry.ID, dest.Key, pf.entry.Size, dest.Status, true)
+	}
+
+	for _, pf := range p.files {
+		if dest.Status == client.StatusSkipUpload && !p.moveOnSkip {
+			break
+		}
+		err = markDone(src, pf.entry.Path, pf.sidecar)
+		if err != nil {
+			return err
+		}
+	}
+
+	p.files = nil
+	p.size = 0
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/psanford/photo-backup-lambda/client"
+)
+
+func TestPackerFlush(t *testing.T) {
+	tests := []struct {
+		name       string
+		dest       *client.UploadDestination
+		moveOnSkip bool
+		wantDone   bool
+	}{
+		{"uploaded", &client.UploadDestination{Status: client.StatusOK, Key: "photos/pack.tar"}, false, true},
+		{"skipped", &client.UploadDestination{Status: client.StatusSkipUpload, Key: "photos/pack.tar"}, false, false},
+		{"skipped, move on skip", &client.UploadDestination{Status: client.StatusSkipUpload, Key: "photos/pack.tar"}, true, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			src := &memSource{
+				files: map[string][]byte{"a.jpg": []byte("small")},
+				done:  make(map[string]bool),
+			}
+			up := &fakeUploader{dest: tc.dest}
+			p := &packer{
+				maxBytes:    1 << 20,
+				testUpload:  true,
+				device:      "laptop",
+				album:       "trips",
+				expireAfter: time.Hour,
+				extraMeta:   map[string]string{"camera": "x100"},
+				moveOnSkip:  tc.moveOnSkip,
+			}
+
+			f, err := src.open("a.jpg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.add(f, "a.jpg", "", client.FileMetadata{Name: "a.jpg", ID: "id", Mtime: f.ModTime()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stats runStats
+			err = p.flush(context.Background(), up, src, &stats, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(up.uploads) != 1 {
+				t.Fatalf("%d uploads, want 1", len(up.uploads))
+			}
+			meta := up.uploads[0]
+			if !meta.TestUpload || meta.Device != "laptop" || meta.Album != "trips" || meta.ExpireAfter != "1h0m0s" || meta.Extra["camera"] != "x100" || meta.Extra["pack-files"] != "1" {
+				t.Errorf("unexpected pack meta %+v", meta)
+			}
+			if src.done["a.jpg"] != tc.wantDone {
+				t.Errorf("done = %v, want %v", src.done["a.jpg"], tc.wantDone)
+			}
+			if len(p.files) != 0 {
+				t.Errorf("%d files left in the packer after flush", len(p.files))
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"io"
+
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/photo-backup-lambda/client"
+)
+
+// imageHash returns the perceptual hash of f, or "" if it isn't an image
+// type the hash supports. Failures are logged but don't fail the upload.
+func imageHash(f io.ReadSeeker, fname, contentType string) string {
+	switch contentType {
+	case "image/gif", "image/jpeg", "image/png":
+	default:
+		return ""
+	}
+
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		log15.Warn("perceptual_hash_err", "name", fname, "err", err)
+		return ""
+	}
+	h, err := client.PerceptualHash(f)
+	if err != nil {
+		log15.Warn("perceptual_hash_err", "name", fname, "err", err)
+		return ""
+	}
+	return h
+}
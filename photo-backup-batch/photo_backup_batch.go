@@ -1,223 +1,983 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	"os"
-	"path/filepath"
-	"strings"
+	"path"
 	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/photo-backup-lambda/client"
+	"github.com/psanford/photo-backup-lambda/internal/clitool"
 )
 
 var (
 	url        = flag.String("url", "", "URL of upload_request handler")
 	username   = flag.String("username", "", "Basic auth username")
 	password   = flag.String("password", "", "Basic auth password")
-	pendingDir = flag.String("pending_dir", "", "Path to pending files")
+	passFile   = flag.String("password-file", "", "Path to file containing basic auth password")
+	pendingDir = flag.String("pending_dir", "", "Path to pending files, or an s3://bucket/prefix to ingest from")
 	doneDir    = flag.String("done_dir", "", "Path to move files to when upload completes")
+
+	configFromSSM = flag.String("config-from-ssm", "", "Read the url, username and password from SSM parameters under this prefix; flags that are set take precedence")
+	ssmRegion     = flag.String("ssm-region", "us-east-1", "AWS region of the -config-from-ssm parameters")
+
+	uploadBandwidth  = flag.Int64("upload-bandwidth", 0, "Initial upload speed estimate in bytes per second, used to request a fresh upload URL when one would expire before a file could finish uploading (0 learns it from uploads)")
+	uploadRetries    = flag.Int("upload-retries", 0, "Retry a failed upload of a file this many times, reopening it for each attempt")
+	streamListing    = flag.Bool("stream-listing", false, "Start uploading while a huge local pending_dir is still being listed, in directory order; can't be used with -checkpoint, -sidecars, -raw-pairs, -retry-from, -discover-types or -order")
+	prefetchHash     = flag.Bool("prefetch-hash", false, "Hash the next file in the background while the current one uploads")
+	hashProgressSize = flag.Int64("hash-progress-size", 512<<20, "Log hashing progress every few seconds for files of at least this many bytes (0 disables)")
+
+	sourceRegion      = flag.String("source-region", "us-east-1", "AWS region of the bucket when pending_dir is an s3:// url")
+	discover          = flag.Bool("discover-types", false, "Report the file extensions and content-types in pending_dir, flagging ones that would be skipped, without uploading")
+	knownIDs          = flag.Bool("known-ids", false, "Fetch the ids the server already has at the start of the run and skip those files locally")
+	knownIDsCacheFile = flag.String("known-ids-cache", "", "Path to cache the known ids in between runs")
+	knownIDsTTL       = flag.Duration("known-ids-ttl", 1*time.Hour, "Max age of the known ids cache")
+	listDoneFiles     = flag.Bool("list-done", false, "Check that every file in done_dir exists on the server, reporting any that are missing, without uploading")
+	planOut           = flag.String("plan-out", "", "Write the computed id, content-type, mtime, key and server decision for every pending file to this JSON file, without uploading")
+	perceptualHash    = flag.Bool("perceptual-hash", false, "Compute a perceptual hash of gif, jpeg and png images and store it as the phash tag, for finding near-duplicates")
+	uploadThumbnails  = flag.Bool("upload-thumbnails", false, "Also upload the thumbnail embedded in a JPEG's EXIF data next to the original")
+	exifTime          = flag.Bool("exif-time", false, "Use the EXIF capture time as the upload mtime, falling back to the file mtime")
+	sidecars          = flag.Bool("sidecars", false, "Store fields from .xmp sidecar files as object metadata; sidecars are not uploaded themselves")
+	sidecarConfFile   = flag.String("sidecar-config", "", "Path to JSON file with the sidecar extensions and field mapping (implies -sidecars)")
+	originalPath      = flag.Bool("original-path", false, "Store each file's path relative to pending_dir as original-path metadata, so a flattened layout can be reversed")
+	timeMetadata      = flag.Bool("time-metadata", false, "Store the filesystem mtime as fs-mtime metadata, the EXIF capture time (if the file has one) as capture-time, and which of them the upload mtime came from as mtime-source")
+	album             = flag.String("album", "", "Store uploads under this album sub-prefix; the server must list it in allowedAlbums")
+	rawPairs          = flag.Bool("raw-pairs", false, "Upload JPEGs and RAW files of the same name as a pair, linked by a shared pair-id metadata value")
+	rawExtensions     = flag.String("raw-extensions", ".arw,.cr2,.cr3,.dng,.nef,.orf,.raf,.rw2", "Comma separated extensions that count as RAW for -raw-pairs")
+	allowAllTypes     = flag.Bool("allow-all-types", false, "Upload every file regardless of content-type instead of only image, audio and video files")
+	contentTypes      = flag.String("content-types", "", "Path to JSON file mapping file extensions to content-types, overriding detection")
+	excludeOlderThan  = flag.String("exclude-older-than", "", "Skip files whose capture time (the EXIF time with -exif-time, otherwise the mtime) is older than this duration or before this date (2006-01-02), without hashing them")
+	resumeFromDone    = flag.Bool("resume-from-done", false, "Skip pending files that have a file with the same name, size and mtime in done_dir, without hashing or asking the server")
+	minDoneFree       = flag.Int64("min-done-free", 0, "Stop the run, leaving the remaining files in pending, if the done_dir filesystem has less than this many bytes free (0 disables)")
+	moveOnSkip        = flag.Bool("move-on-skip", true, "Move files the server already has to done_dir")
+	idsFile           = flag.String("ids-file", "", "Path to precomputed ids in sha256sum format; listed files are not hashed locally and s3 rejects the upload if an id is wrong")
+	hashCacheFile     = flag.String("hash-cache", "", "Path to an id cache written by the hash subcommand; files whose size and mtime match are not re-hashed")
+	maxFiles          = flag.Int("max-files", 0, "Stop after this many files have been uploaded or skipped (0 means no limit)")
+	order             = flag.String("order", "name", "Order to process files in: name|mtime|exif-time (oldest first)")
+	packMaxFileSize   = flag.Int64("pack-max-file-size", 0, "Upload files up to this many bytes together in tar packs instead of one object each (0 disables packing)")
+	packSize          = flag.Int64("pack-size", 64<<20, "Upload a pack once it holds this many bytes of files")
+	runManifestPrefix = flag.String("write-run-manifest", "", "At the end of the run, store a manifest of the ids, keys and sizes it uploaded or skipped under this prefix of the server's run manifest prefix (best effort)")
+	stateFile         = flag.String("state-file", "", "Path to a journal that makes moving a file to done_dir the step committing its upload, so a run resuming after a crash doesn't repeat an upload's side effects")
+	failuresOut       = flag.String("failures-out", "", "Write the paths of files that failed or timed out to this file, for -retry-from")
+	retryFrom         = flag.String("retry-from", "", "Process only the paths listed in this file (as written by -failures-out) instead of listing pending_dir")
+	checkpointFile    = flag.String("checkpoint", "", "Path to checkpoint file used to resume interrupted runs")
+	clientCert        = flag.String("client-cert", "", "Client TLS certificate file for mutual TLS")
+	clientKey         = flag.String("client-key", "", "Client TLS key file for mutual TLS")
+	testUpload        = flag.Bool("test", false, "Mark uploads as test uploads")
+	device            = flag.String("device", clitool.Hostname(), "Device name recorded with each upload")
+	expireAfter       = flag.Duration("expire-after", 0, "Have uploads deleted by the bucket lifecycle after this long (0 keeps them)")
+	http2             = flag.Bool("http2", true, "Use HTTP/2 when the server supports it")
+	logLevel          = flag.String("log-level", "info", "Log level: debug|info|warn|error|crit")
+	debug             = flag.Bool("debug", false, "Enable debug logging, including http request tracing")
+	quiet             = flag.Bool("quiet", false, "Only log warnings, errors and the run summary")
+	verbose           = flag.Bool("verbose", false, "Log per-file detail: id, content-type, capture time source and object key")
+	verifyAfterUpload = flag.Bool("verify-after-upload", false, "HEAD each uploaded object and only move the file to done if it exists with the expected size and id")
+	uploadTimeout     = flag.Duration("upload-timeout", 0, "Max time for a single file upload attempt (0 means no limit)")
+	onError           = flag.String("on-error", "stop", "What to do when a file fails: stop|continue (continue leaves it in pending and exits non-zero at the end)")
+	maxFailures       = flag.Int("max-consecutive-failures", 0, "Leave failed files in pending and pause after this many consecutive upload failures (0 aborts on the first failure)")
+	failureBackoff    = flag.Duration("failure-backoff", 30*time.Second, "Initial pause after -max-consecutive-failures failures, doubled on each pause")
+	maxPauses         = flag.Int("max-pauses", 5, "Abort the run once it has paused this many times without a successful upload")
 )
 
+var extraMeta = make(metaFlag)
+
+func init() {
+	flag.Var(extraMeta, "meta", "Extra key=value metadata stored with every upload (repeatable)")
+}
+
 func main() {
 	flag.Parse()
-	err := run()
+
+	err := clitool.SetupLogging(*logLevel, *debug, *quiet, *verbose)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if flag.Arg(0) == "hash" {
+		err = runHash(flag.Args()[1:])
+	} else {
+		err = run()
+	}
+	if err != nil {
+		log15.Crit("run_err", "err", err)
+		os.Exit(1)
 	}
 }
 
 func run() error {
-	if *url == "" {
-		return fmt.Errorf("-url is required")
+	if *listDoneFiles {
+		return runListDone()
 	}
 
 	if *pendingDir == "" {
 		return fmt.Errorf("-pending_dir is required")
 	}
-	files, err := os.ReadDir(*pendingDir)
+	if *onError != "stop" && *onError != "continue" {
+		return fmt.Errorf("invalid -on-error %q, expected stop or continue", *onError)
+	}
+	src, err := newSource(*pendingDir, *doneDir, *sourceRegion, *discover || *planOut != "")
 	if err != nil {
 		return err
 	}
 
-	err = os.MkdirAll(*doneDir, 0700)
+	var done *localSource
+	if *resumeFromDone {
+		ls, ok := src.(*localSource)
+		if !ok || ls.doneDir == "" {
+			return fmt.Errorf("-resume-from-done requires a local pending_dir and -done_dir")
+		}
+		done = ls
+	}
+
+	var doneFS *localSource
+	if *minDoneFree > 0 && !*discover && *planOut == "" {
+		ls, ok := src.(*localSource)
+		if !ok {
+			return fmt.Errorf("-min-done-free requires a local pending_dir")
+		}
+		doneFS = ls
+		err = doneFS.checkDoneFree(*minDoneFree)
+		if err != nil {
+			return err
+		}
+	}
+
+	excludeBefore, err := parseCutoff(*excludeOlderThan, time.Now())
 	if err != nil {
 		return err
 	}
 
-	for i, finfo := range files {
-		err := func() error {
-			i := i
-			finfo := finfo
-			srcPath := filepath.Join(*pendingDir, finfo.Name())
-			f, err := os.Open(srcPath)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
+	var (
+		files  []string
+		stream *fileQueue
+	)
+	if *streamListing {
+		ls, ok := src.(*localSource)
+		if !ok {
+			return fmt.Errorf("-stream-listing requires a local pending_dir")
+		}
+		if *checkpointFile != "" || *sidecars || *sidecarConfFile != "" || *rawPairs || *retryFrom != "" || *discover || *order != "name" {
+			return fmt.Errorf("-stream-listing can't be used with -checkpoint, -sidecars, -sidecar-config, -raw-pairs, -retry-from, -discover-types or -order")
+		}
+		stream = ls.stream()
+	} else if *retryFrom != "" {
+		files, err = loadRetryList(*retryFrom)
+		if err != nil {
+			return err
+		}
+		log15.Info("retry_from", "path", *retryFrom, "files", len(files))
+	} else {
+		files, err = src.list()
+		if err != nil {
+			return err
+		}
+	}
 
-			summer := sha256.New()
-			_, err = io.Copy(summer, f)
-			if err != nil {
-				return err
-			}
+	rawExts := parseExtensions(*rawExtensions)
 
-			id := hex.EncodeToString(summer.Sum(nil))
-			stat, err := f.Stat()
+	var (
+		sidecarConf *sidecarConfig
+		sidecarFor  map[string]string
+	)
+	if *sidecars || *sidecarConfFile != "" {
+		sidecarConf = &defaultSidecarConfig
+		if *sidecarConfFile != "" {
+			sidecarConf, err = loadSidecarConfig(*sidecarConfFile)
 			if err != nil {
 				return err
 			}
+		}
+		if *rawPairs {
+			sidecarConf = sidecarConf.withoutExtensions(rawExts)
+		}
+		files, sidecarFor = sidecarConf.matchSidecars(files)
+		log15.Info("sidecars_matched", "count", len(sidecarFor))
+	}
 
-			size := stat.Size()
-			mtime := stat.ModTime()
+	var pairs map[string]string
+	if *rawPairs {
+		pairs = matchRawPairs(files, rawExts)
+		log15.Info("raw_pairs_matched", "pairs", len(pairs)/2)
+	}
 
-			name := filepath.Base(finfo.Name())
+	var overrides contentTypeOverrides
+	if *contentTypes != "" {
+		overrides, err = loadContentTypeOverrides(*contentTypes)
+		if err != nil {
+			return err
+		}
+	}
 
-			header := make([]byte, 512)
-			f.Seek(0, io.SeekStart)
-			io.ReadFull(f, header)
+	if *discover {
+		return discoverTypes(src, files, overrides)
+	}
 
-			contentType := http.DetectContentType(header)
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
 
-			contentParts := strings.SplitN(contentType, "/", 2)
-			if contentParts[0] != "image" && contentParts[0] != "audio" && contentParts[0] != "video" {
-				log.Printf("%s not a media file, content-type: %s", finfo.Name(), contentType)
-				return nil
-			}
+	files, captured, err := orderFiles(src, files, *order)
+	if err != nil {
+		return err
+	}
+
+	planning := *planOut != ""
+
+	var cp *checkpoint
+	if *checkpointFile != "" {
+		if *order != "name" {
+			// checkpoints resume by name, which only works in name order
+			return fmt.Errorf("-checkpoint requires -order name")
+		}
+		cp, err = loadCheckpoint(*checkpointFile)
+		if err != nil {
+			return fmt.Errorf("load checkpoint err: %w", err)
+		}
+		if cp.PendingDir != *pendingDir {
+			cp = &checkpoint{PendingDir: *pendingDir}
+		} else if cp.LastName != "" {
+			log15.Info("resume_from_checkpoint", "last_name", cp.LastName, "processed", cp.Processed)
+		}
+	}
 
-			log.Printf("[%d/%d] upload: %s\n", i+1, len(files), name)
+	var pk *packer
+	if *packMaxFileSize > 0 && !planning {
+		if cp != nil {
+			// packed files aren't done until their pack is, which a
+			// checkpoint by name can't represent
+			return fmt.Errorf("-checkpoint can't be used with -pack-max-file-size")
+		}
+		pk = &packer{
+			maxBytes:    *packSize,
+			testUpload:  *testUpload,
+			device:      *device,
+			album:       *album,
+			expireAfter: *expireAfter,
+			extraMeta:   extraMeta,
+			moveOnSkip:  *moveOnSkip,
+		}
+	}
+
+	var ids map[string]string
+	if *idsFile != "" {
+		ids, err = loadIDsFile(*idsFile)
+		if err != nil {
+			return err
+		}
+		log15.Info("loaded_ids_file", "path", *idsFile, "ids", len(ids))
+	}
 
-			dest, err := requestUploadURL(id, name, contentType, mtime, size)
+	var hashes hashCache
+	if *hashCacheFile != "" {
+		hashes, err = loadHashCache(*hashCacheFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var known map[string]bool
+	if *knownIDs {
+		known, err = loadKnownIDs(ctx, c, *knownIDsCacheFile, *knownIDsTTL)
+		if err != nil {
+			return fmt.Errorf("load known ids err: %w", err)
+		}
+	}
+
+	b := &batchRun{
+		src:         src,
+		up:          c,
+		total:       len(files),
+		done:        done,
+		sidecarConf: sidecarConf,
+		sidecarFor:  sidecarFor,
+		overrides:   overrides,
+		captured:    captured,
+		ids:         ids,
+		hashes:      hashes,
+		known:       known,
+		pk:          pk,
+		breaker: &circuitBreaker{
+			maxFailures: *maxFailures,
+			maxPauses:   *maxPauses,
+			backoff:     *failureBackoff,
+		},
+		excludeBefore: excludeBefore,
+		planning:      planning,
+
+		pairs:   pairs,
+		rawExts: rawExts,
+
+		moveOnSkip:       *moveOnSkip,
+		exifTime:         *exifTime,
+		timeMetadata:     *timeMetadata,
+		testUpload:       *testUpload,
+		device:           *device,
+		album:            *album,
+		expireAfter:      *expireAfter,
+		extraMeta:        extraMeta,
+		perceptualHash:   *perceptualHash,
+		originalPath:     *originalPath,
+		packMaxFileSize:  *packMaxFileSize,
+		uploadThumbnails: *uploadThumbnails,
+		allowAllTypes:    *allowAllTypes,
+	}
+	defer b.stats.log()
+
+	if *runManifestPrefix != "" && !planning {
+		b.manifest = &runManifest{
+			Started:    time.Now(),
+			Device:     *device,
+			PendingDir: *pendingDir,
+			TestUpload: *testUpload,
+		}
+		defer b.manifest.write(ctx, c, *runManifestPrefix, &b.stats)
+	}
+
+	if *stateFile != "" && !planning {
+		b.state, err = openUploadState(*stateFile)
+		if err != nil {
+			return fmt.Errorf("open state file err: %w", err)
+		}
+		defer b.state.close()
+	}
+
+	var failures []fileError
+	// failedNames are the files for -failures-out, which also covers
+	// timeouts and the file a run aborted on
+	var failedNames []string
+	if *failuresOut != "" {
+		defer func() {
+			err := writeFailures(*failuresOut, failedNames, sidecarFor)
 			if err != nil {
-				return err
+				log15.Error("write_failures_err", "path", *failuresOut, "err", err)
+				return
 			}
+			log15.Info("wrote_failures", "path", *failuresOut, "files", len(failedNames))
+		}()
+	}
 
-			if dest.Status == StatusSkipUpload {
-				log.Printf("upload already exists, skipping. id=%s", id)
-
-				err = os.Rename(srcPath, filepath.Join(*doneDir, finfo.Name()))
-				if err != nil {
-					return err
-				}
+	queue := stream
+	if queue == nil {
+		queue = &fileQueue{files: files}
+	}
+	var next *hashPrefetch
+	for i := 0; ; i++ {
+		fname, ok := queue.pop()
+		if !ok {
+			break
+		}
+		if cp != nil && fname <= cp.LastName {
+			continue
+		}
 
-				return nil
+		if *prefetchHash {
+			b.prefetch = next
+			next = nil
+			if name, ok := queue.peek(); ok {
+				next = b.startPrefetch(name)
 			}
+		}
 
-			f.Seek(0, io.SeekStart)
-			err = uploadFile(f, size, dest)
+		if doneFS != nil {
+			// checked before every file so nothing is uploaded that
+			// can't then be moved to done
+			err := doneFS.checkDoneFree(*minDoneFree)
 			if err != nil {
 				return err
 			}
+		}
+
+		err := b.processFile(ctx, i+1, fname)
 
-			err = os.Rename(srcPath, filepath.Join(*doneDir, finfo.Name()))
+		if client.IsReadOnly(err) {
+			// a soft stop: this and the remaining files stay in pending
+			// for a later run
+			var serr *client.ServerError
+			errors.As(err, &serr)
+			log15.Warn("server_read_only_stop", "name", fname, "retry_after", serr.RetryAfter, "err", err)
+			b.stats.readOnly = true
+			break
+		}
+		if errors.Is(err, client.ErrFileChanged) {
+			// most likely still being written or synced; a later run
+			// picks it up once it settles
+			log15.Warn("file_changed_during_upload_leave_in_pending", "name", fname)
+			b.stats.changed++
+			failedNames = append(failedNames, fname)
+			cp = nil
+			continue
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			log15.Warn("upload_timeout_leave_in_pending", "name", fname)
+			b.stats.timedOut++
+			failedNames = append(failedNames, fname)
+			// don't let the checkpoint advance past a file we left behind
+			cp = nil
+			continue
+		}
+		if err != nil && isUpstreamErr(err) && *maxFailures > 0 {
+			log15.Warn("upload_failed_leave_in_pending", "name", fname, "err", err)
+			b.stats.failed++
+			failedNames = append(failedNames, fname)
+			cp = nil
+			err = b.breaker.failure(err)
 			if err != nil {
 				return err
 			}
+			continue
+		}
+		if err != nil && *onError == "continue" {
+			log15.Error("file_failed_leave_in_pending", "name", fname, "err", err)
+			failures = append(failures, fileError{fname, err})
+			b.stats.failed++
+			failedNames = append(failedNames, fname)
+			cp = nil
+			continue
+		}
+		if err != nil {
+			failedNames = append(failedNames, fname)
+			return err
+		}
+
+		if cp != nil {
+			cp.LastName = fname
+			cp.Processed++
+			err = cp.save(*checkpointFile)
+			if err != nil {
+				return fmt.Errorf("save checkpoint err: %w", err)
+			}
+		}
 
-			log.Printf("Upload success!, id=%s", id)
-			return nil
-		}()
+		if *maxFiles > 0 && b.stats.uploaded+b.stats.skipped >= *maxFiles {
+			log15.Info("max_files_reached", "max_files", *maxFiles)
+			b.stats.hitMaxFiles = true
+			break
+		}
+	}
+
+	if err := queue.err(); err != nil {
+		return fmt.Errorf("stream listing err: %w", err)
+	}
+
+	if b.pk != nil && !b.stats.readOnly {
+		err = b.pk.flush(ctx, b.up, b.src, &b.stats, b.manifest)
+		if err != nil {
+			return err
+		}
+	}
 
+	if planning {
+		err = writePlan(*planOut, b.plan)
 		if err != nil {
 			return err
 		}
+		log15.Info("wrote_plan", "path", *planOut, "files", len(b.plan))
+	}
+
+	if len(failures) > 0 {
+		for _, f := range failures {
+			log15.Error("failed_file", "name", f.name, "err", f.err)
+		}
+		return fmt.Errorf("%d files failed", len(failures))
+	}
+
+	if planning {
+		return nil
+	}
+
+	// keep the checkpoint so the next run resumes after the limit or
+	// read-only stop
+	if cp != nil && *checkpointFile != "" && !b.stats.hitMaxFiles && !b.stats.readOnly {
+		err = os.Remove(*checkpointFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func uploadFile(r io.Reader, size int64, dest *UploadDestination) error {
-	if dest.Method == "" {
-		dest.Method = "PUT"
-	}
-	req, err := http.NewRequest(dest.Method, dest.URL, r)
+// uploader is the part of *client.Client a run uses.
+type uploader interface {
+	Upload(ctx context.Context, r io.ReadSeeker, meta client.FileMetadata) (*client.UploadDestination, error)
+	RequestUploadURL(ctx context.Context, meta client.FileMetadata) (*client.UploadDestination, error)
+}
+
+// batchRun is the state shared by the files of one run. The source and
+// uploader are interfaces so processFile can be driven without a real
+// pending dir or server.
+type batchRun struct {
+	src source
+	up  uploader
+	// total is the number of files in the run, for progress logging, or 0
+	// with -stream-listing.
+	total int
+
+	done        *localSource
+	sidecarConf *sidecarConfig
+	sidecarFor  map[string]string
+	overrides   contentTypeOverrides
+	captured    map[string]capturedTime
+	ids         map[string]string
+	hashes      hashCache
+	known       map[string]bool
+	pk          *packer
+	breaker     *circuitBreaker
+
+	// excludeBefore, if set, is the capture time files must not predate.
+	excludeBefore time.Time
+
+	// manifest, if set, records what the run stored for -write-run-manifest.
+	manifest *runManifest
+
+	// pairs maps each file of a RAW+JPEG pair to the other, for
+	// -raw-pairs.
+	pairs   map[string]string
+	rawExts []string
+
+	// prefetch is the background hash of the file being processed, for
+	// -prefetch-hash.
+	prefetch *hashPrefetch
+
+	// state is the -state-file journal, or nil.
+	state *uploadState
+
+	// the flag values processFile uses, so tests can set them per run
+	moveOnSkip       bool
+	exifTime         bool
+	timeMetadata     bool
+	testUpload       bool
+	device           string
+	album            string
+	expireAfter      time.Duration
+	extraMeta        map[string]string
+	perceptualHash   bool
+	originalPath     bool
+	packMaxFileSize  int64
+	uploadThumbnails bool
+	allowAllTypes    bool
+
+	planning bool
+	plan     []planEntry
+	stats    runStats
+}
+
+// processFile uploads, skips or plans the n'th file of the run.
+func (b *batchRun) processFile(ctx context.Context, n int, fname string) error {
+	f, err := b.src.open(fname)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	req.Header = dest.Headers
-	req.ContentLength = size
+	if e, ok := b.state.uploaded(fname, f); ok {
+		log15.Info("resume_uncommitted_upload", "name", fname, "id", e.Meta.ID, "key", e.Key)
+		return b.finishUpload(ctx, f, e)
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	if b.done != nil && b.done.inDone(fname, f) {
+		log15.Info("done_dir_match_skip", "name", fname)
+		b.stats.skipped++
+		if b.planning {
+			b.plan = append(b.plan, planEntry{
+				Path:        fname,
+				Mtime:       f.ModTime(),
+				MtimeSource: timeSourceFS,
+				Decision:    planSkipDone,
+			})
+			return nil
+		}
+		if !b.moveOnSkip {
+			return nil
+		}
+		return markDone(b.src, fname, b.sidecarFor[fname])
+	}
+
+	// the capture time is needed before hashing so excluded files are
+	// never read in full
+	mtime := f.ModTime()
+	mtimeSource := timeSourceFS
+	var (
+		timeReason error
+		exifAt     time.Time
+	)
+	if b.exifTime || b.timeMetadata {
+		ct, ok := b.captured[fname]
+		if !ok {
+			ct.t, ct.source, ct.reason = captureTime(f, mtime)
+		}
+		if b.exifTime {
+			mtime, mtimeSource, timeReason = ct.t, ct.source, ct.reason
+		}
+		if ct.source == timeSourceEXIF {
+			exifAt = ct.t
+		}
+	}
+
+	if !b.excludeBefore.IsZero() && mtime.Before(b.excludeBefore) {
+		log15.Debug("excluded_too_old", "name", fname, "mtime", mtime, "mtime_source", mtimeSource)
+		b.stats.tooOld++
+		if b.planning {
+			b.plan = append(b.plan, planEntry{
+				Path:        fname,
+				Mtime:       mtime,
+				MtimeSource: mtimeSource,
+				Decision:    planTooOld,
+			})
+		}
+		return nil
+	}
+
+	id, contentType, err := b.fileID(fname, f)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("uploadFile: non-200 status code: %d\n%s\n", resp.StatusCode, body)
+
+	name := path.Base(fname)
+	if override, ok := b.overrides.lookup(name); ok {
+		contentType = override
+	} else if _, paired := b.pairs[fname]; paired && hasExt(name, b.rawExts) {
+		contentType = rawContentType(name, contentType)
 	}
 
-	return nil
-}
+	if !isMediaType(contentType, b.allowAllTypes) {
+		log15.Info("not_media_file", "name", fname, "content_type", contentType)
+		b.stats.notMedia++
+		if b.planning {
+			b.plan = append(b.plan, planEntry{
+				Path:        fname,
+				ID:          id,
+				ContentType: contentType,
+				Mtime:       mtime,
+				MtimeSource: mtimeSource,
+				Decision:    planNotMedia,
+			})
+		}
+		return nil
+	}
+
+	if timeReason != nil {
+		log15.Debug("exif_fallback_to_fs_mtime", "name", name, "content_type", contentType, "reason", timeReason)
+		b.stats.exifFallback++
+	}
+
+	entry := planEntry{
+		Path:        fname,
+		ID:          id,
+		ContentType: contentType,
+		Mtime:       mtime,
+		MtimeSource: mtimeSource,
+	}
 
-func requestUploadURL(id, name, contentType string, mtime time.Time, size int64) (*UploadDestination, error) {
-	meta := FileMetadata{
+	if b.known[id] {
+		log15.Info("known_id_skip", "id", id, "name", name)
+		b.stats.skipped++
+		if b.planning {
+			entry.Decision = planSkipKnown
+			b.plan = append(b.plan, entry)
+			return nil
+		}
+		if !b.moveOnSkip {
+			return nil
+		}
+		return markDone(b.src, fname, b.sidecarFor[fname])
+	}
+
+	log15.Info("upload", "n", n, "total", b.total, "name", name)
+	log15.Debug("upload_detail", "name", name, "id", id, "content_type", contentType, "mtime", mtime, "mtime_source", mtimeSource)
+
+	meta := client.FileMetadata{
 		ID:          id,
 		Name:        name,
 		Mtime:       mtime,
-		Bytes:       size,
-		TestUpload:  true,
+		Bytes:       f.Size(),
 		ContentType: contentType,
+		TestUpload:  b.testUpload,
+		Device:      b.device,
+		Album:       b.album,
+	}
+	if b.expireAfter > 0 {
+		meta.ExpireAfter = b.expireAfter.String()
+	}
+	if b.perceptualHash {
+		meta.PerceptualHash = imageHash(f, fname, contentType)
 	}
 
-	jsontxt, err := json.Marshal(meta)
-	if err != nil {
-		return nil, err
+	if len(b.extraMeta) > 0 {
+		meta.Extra = make(map[string]string, len(b.extraMeta))
+		for k, v := range b.extraMeta {
+			meta.Extra[k] = v
+		}
+	}
+	if sc := b.sidecarFor[fname]; sc != "" {
+		md, err := b.sidecarConf.read(b.src, sc)
+		if err != nil {
+			log15.Warn("sidecar_err", "name", fname, "sidecar", sc, "err", err)
+		} else if meta.Extra == nil {
+			meta.Extra = md
+		} else {
+			// per-file sidecar values win over -meta
+			for k, v := range md {
+				meta.Extra[k] = v
+			}
+		}
+	}
+	if _, ok := b.pairs[fname]; ok {
+		pairID, err := b.pairID(fname, id)
+		if err != nil {
+			return fmt.Errorf("pair id of %s: %w", fname, err)
+		}
+		if meta.Extra == nil {
+			meta.Extra = make(map[string]string)
+		}
+		meta.Extra["pair-id"] = pairID
+	}
+	if b.originalPath {
+		if meta.Extra == nil {
+			meta.Extra = make(map[string]string)
+		}
+		meta.Extra["original-path"] = fname
+	}
+	if b.timeMetadata {
+		if meta.Extra == nil {
+			meta.Extra = make(map[string]string)
+		}
+		meta.Extra["fs-mtime"] = f.ModTime().Format(time.RFC3339)
+		meta.Extra["mtime-source"] = string(mtimeSource)
+		if !exifAt.IsZero() {
+			meta.Extra["capture-time"] = exifAt.Format(time.RFC3339)
+		}
 	}
-	buf := bytes.NewBuffer(jsontxt)
 
-	req, err := http.NewRequest("POST", *url, buf)
-	if err != nil {
-		return nil, err
+	if b.planning {
+		meta.ValidateOnly = true
+		dest, err := b.up.RequestUploadURL(ctx, meta)
+		var serr *client.ServerError
+		if errors.As(err, &serr) && serr.Decision == "would-reject" {
+			log15.Warn("plan_would_reject", "name", fname, "code", serr.Code, "err", serr.Message)
+			entry.Decision = planReject
+			entry.ErrorCode = serr.Code
+			b.plan = append(b.plan, entry)
+			return nil
+		}
+		if err != nil {
+			return upstreamError{err}
+		}
+		b.breaker.success()
+		entry.Key = dest.Key
+		entry.Decision = planUpload
+		if dest.Status == client.StatusSkipUpload {
+			entry.Decision = planSkip
+		}
+		b.plan = append(b.plan, entry)
+		return nil
+	}
+
+	if b.pk != nil && f.Size() <= b.packMaxFileSize {
+		// the server decides skips per file, so ask before packing or a
+		// file it already has on its own is stored again in the pack
+		check := meta
+		check.ValidateOnly = true
+		dest, err := b.up.RequestUploadURL(ctx, check)
+		if err != nil {
+			return upstreamError{err}
+		}
+		b.breaker.success()
+		if dest.Status == client.StatusSkipUpload {
+			log15.Info("pack_file_already_exists", "name", name, "key", dest.Key)
+			return b.finishUpload(ctx, f, &stateEntry{
+				Path:    fname,
+				Size:    f.Size(),
+				ModTime: f.ModTime(),
+				Key:     dest.Key,
+				Status:  dest.Status,
+				Meta:    meta,
+			})
+		}
+
+		err = b.pk.add(f, fname, b.sidecarFor[fname], meta)
+		if err != nil {
+			return err
+		}
+		if !b.pk.full() {
+			return nil
+		}
+		return b.pk.flush(ctx, b.up, b.src, &b.stats, b.manifest)
 	}
-	req.Header.Add("content-type", "application/json")
-	req.SetBasicAuth(*username, *password)
 
-	resp, err := http.DefaultClient.Do(req)
+	dest, err := b.up.Upload(ctx, f, meta)
+	if errors.Is(err, client.ErrIDMismatch) {
+		if _, ok := b.ids[fname]; ok {
+			// the file didn't change, the -ids-file entry is wrong
+			return fmt.Errorf("%s: -ids-file id %s is wrong: %w", fname, id, err)
+		}
+		// the size matched but the bytes didn't hash to what we just
+		// computed, so the file was rewritten in place
+		err = fmt.Errorf("%v: %w", err, client.ErrFileChanged)
+	}
+	if errors.Is(err, client.ErrFileChanged) {
+		// a local problem, it shouldn't count toward -max-failures
+		return err
+	}
 	if err != nil {
-		return nil, err
+		return upstreamError{err}
 	}
-	defer resp.Body.Close()
+	b.breaker.success()
+	log15.Debug("upload_dest", "name", name, "key", dest.Key, "status", dest.Status, "method", dest.Method)
 
-	if resp.StatusCode != 200 && resp.StatusCode != http.StatusConflict {
-		return nil, fmt.Errorf("non-200 status code: %d", resp.StatusCode)
+	if dest.MarkerErr != nil {
+		log15.Warn("marker_write_err", "key", dest.Marker.Key, "err", dest.MarkerErr)
 	}
 
-	var dest UploadDestination
-	err = json.NewDecoder(resp.Body).Decode(&dest)
+	return b.finishUpload(ctx, f, &stateEntry{
+		Path:    fname,
+		Size:    f.Size(),
+		ModTime: f.ModTime(),
+		Key:     dest.Key,
+		Status:  dest.Status,
+		Meta:    meta,
+	})
+}
+
+// finishUpload runs the steps after the server has a file: the thumbnail,
+// the run manifest entry and the move to done_dir. With -state-file each
+// step is journaled so a run resuming from e doesn't repeat it.
+func (b *batchRun) finishUpload(ctx context.Context, f sourceFile, e *stateEntry) error {
+	fname, meta := e.Path, e.Meta
+	id := meta.ID
+	commit := e.Status != client.StatusSkipUpload || b.moveOnSkip
+	if commit {
+		err := b.state.record(e)
+		if err != nil {
+			return fmt.Errorf("write state file err: %w", err)
+		}
+	}
+
+	if b.uploadThumbnails && !e.Thumbnailed {
+		if uploadThumbnail(ctx, b.up, f, e.Key, meta) {
+			b.stats.thumbnails++
+		}
+		if commit {
+			e.Thumbnailed = true
+			err := b.state.record(e)
+			if err != nil {
+				return fmt.Errorf("write state file err: %w", err)
+			}
+		}
+	}
+
+	b.manifest.add(fname, id, e.Key, meta.Bytes, e.Status, false)
+
+	if e.Status == client.StatusSkipUpload {
+		if !b.moveOnSkip {
+			log15.Info("upload_already_exists_leave_in_pending", "id", id, "key", e.Key)
+			b.stats.skipped++
+			return nil
+		}
+
+		log15.Info("upload_already_exists_move_to_done", "id", id, "key", e.Key)
+
+		err := b.commitDone(fname)
+		if err != nil {
+			return err
+		}
+
+		b.stats.skipped++
+		return nil
+	}
+
+	err := b.commitDone(fname)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &dest, nil
+	log15.Info("upload_success", "id", id)
+	b.stats.uploaded++
+	return nil
 }
 
-type UploadDestination struct {
-	Status  Status      `json:"status"`
-	Error   string      `json:"error,omitempty"`
-	URL     string      `json:"url"`
-	Method  string      `json:"method"`
-	Headers http.Header `json:"headers"`
+// commitDone moves fname to done_dir and, with -state-file, records that
+// its upload is committed.
+func (b *batchRun) commitDone(fname string) error {
+	err := markDone(b.src, fname, b.sidecarFor[fname])
+	if err != nil || b.state == nil {
+		return err
+	}
+	if ls, ok := b.src.(*localSource); ok {
+		err = syncDir(ls.doneDir)
+		if err != nil {
+			log15.Warn("sync_done_dir_err", "dir", ls.doneDir, "err", err)
+		}
+	}
+	return b.state.done(fname)
 }
 
-type FileMetadata struct {
-	ID          string    `json:"id"`
-	Name        string    `json:"name"`
-	Mtime       time.Time `json:"mtime"`
-	Bytes       int64     `json:"size"`
-	ContentType string    `json:"content_type"`
-	TestUpload  bool      `json:"test_upload"`
+func newClient() (*client.Client, error) {
+	if *configFromSSM != "" {
+		conf, err := clitool.LoadSSMConfig(*configFromSSM, *ssmRegion)
+		if err != nil {
+			return nil, err
+		}
+		conf.Apply(url, username, password, *passFile)
+	}
+
+	if *url == "" {
+		return nil, fmt.Errorf("-url is required")
+	}
+
+	pass, err := clitool.ResolvePassword(*password, *passFile)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := clitool.NewHTTPClient(clitool.HTTPConfig{
+		CertFile: *clientCert,
+		KeyFile:  *clientKey,
+		Retries:  2,
+		HTTP2:    *http2,
+		Trace:    *debug,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return client.New(*url, *username, pass,
+		client.WithHTTPClient(httpClient),
+		client.WithUploadTimeout(*uploadTimeout),
+		client.WithVerifyAfterUpload(*verifyAfterUpload),
+		client.WithUploadBandwidth(*uploadBandwidth),
+		client.WithRetries(*uploadRetries, time.Second),
+	), nil
 }
 
-type Status string
+func runListDone() error {
+	if *doneDir == "" {
+		return fmt.Errorf("-done_dir is required")
+	}
 
-var (
-	StatusOK         Status = "ok"
-	StatusSkipUpload Status = "skip" // file already exists
-	StatusErr        Status = "error"
-)
+	var (
+		overrides contentTypeOverrides
+		err       error
+	)
+	if *contentTypes != "" {
+		overrides, err = loadContentTypeOverrides(*contentTypes)
+		if err != nil {
+			return err
+		}
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	return listDone(context.Background(), c, *doneDir, overrides, *album)
+}
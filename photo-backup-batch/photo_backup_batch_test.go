@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/psanford/photo-backup-lambda/client"
+)
+
+type memSource struct {
+	files map[string][]byte
+	done  map[string]bool
+}
+
+func (s *memSource) list() ([]string, error) {
+	var names []string
+	for name := range s.files {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *memSource) open(name string) (sourceFile, error) {
+	data, ok := s.files[name]
+	if !ok {
+		return nil, errors.New("no such file")
+	}
+	return memFile{bytes.NewReader(data)}, nil
+}
+
+func (s *memSource) markDone(name string) error {
+	s.done[name] = true
+	return nil
+}
+
+type memFile struct {
+	*bytes.Reader
+}
+
+func (f memFile) Close() error       { return nil }
+func (f memFile) ModTime() time.Time { return time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC) }
+
+type fakeUploader struct {
+	dest *client.UploadDestination
+	err  error
+
+	uploads []client.FileMetadata
+}
+
+func (u *fakeUploader) Upload(ctx context.Context, r io.ReadSeeker, meta client.FileMetadata) (*client.UploadDestination, error) {
+	u.uploads = append(u.uploads, meta)
+	return u.dest, u.err
+}
+
+func (u *fakeUploader) RequestUploadURL(ctx context.Context, meta client.FileMetadata) (*client.UploadDestination, error) {
+	return u.dest, u.err
+}
+
+func TestProcessFile(t *testing.T) {
+	jpeg := []byte("\xff\xd8\xff\xe0 not really a jpeg")
+	jpegID, _, err := client.ComputeIDAndContentType(bytes.NewReader(jpeg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := []byte("hello")
+
+	uploaded := &client.UploadDestination{Status: client.StatusOK, Key: "photos/a.jpg"}
+	skipped := &client.UploadDestination{Status: client.StatusSkipUpload, Key: "photos/a.jpg"}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		dest       *client.UploadDestination
+		uploadErr  error
+		known      bool
+		fromIDs    bool
+		moveOnSkip bool
+		allowAll   bool
+		expire     time.Duration
+		pack       bool
+
+		wantUpload   bool
+		wantPacked   bool
+		wantDone     bool
+		wantUpstream bool
+		wantChanged  bool
+		wantErr      bool
+		wantExpire   string
+		wantStats    runStats
+	}{
+		{
+			name:       "upload",
+			data:       jpeg,
+			dest:       uploaded,
+			wantUpload: true,
+			wantDone:   true,
+			wantStats:  runStats{uploaded: 1},
+		},
+		{
+			name:       "server has it, move on skip",
+			data:       jpeg,
+			dest:       skipped,
+			moveOnSkip: true,
+			wantUpload: true,
+			wantDone:   true,
+			wantStats:  runStats{skipped: 1},
+		},
+		{
+			name:       "server has it, leave in pending",
+			data:       jpeg,
+			dest:       skipped,
+			wantUpload: true,
+			wantStats:  runStats{skipped: 1},
+		},
+		{
+			name:       "known id",
+			data:       jpeg,
+			known:      true,
+			moveOnSkip: true,
+			wantDone:   true,
+			wantStats:  runStats{skipped: 1},
+		},
+		{
+			name:      "not media",
+			data:      text,
+			wantStats: runStats{notMedia: 1},
+		},
+		{
+			name:       "not media with allow all types",
+			data:       text,
+			dest:       uploaded,
+			allowAll:   true,
+			wantUpload: true,
+			wantDone:   true,
+			wantStats:  runStats{uploaded: 1},
+		},
+		{
+			name:         "upload error",
+			data:         jpeg,
+			uploadErr:    errors.New("503 slow down"),
+			wantUpload:   true,
+			wantUpstream: true,
+		},
+		{
+			name:        "rewritten during upload",
+			data:        jpeg,
+			uploadErr:   fmt.Errorf("a.jpg: %w", client.ErrIDMismatch),
+			wantUpload:  true,
+			wantChanged: true,
+		},
+		{
+			name:       "expire after",
+			data:       jpeg,
+			dest:       uploaded,
+			expire:     90 * time.Minute,
+			wantUpload: true,
+			wantDone:   true,
+			wantExpire: "1h30m0s",
+			wantStats:  runStats{uploaded: 1},
+		},
+		{
+			name:       "packed",
+			data:       jpeg,
+			dest:       uploaded,
+			pack:       true,
+			wantPacked: true,
+		},
+		{
+			name:       "server has it on its own, not packed",
+			data:       jpeg,
+			dest:       skipped,
+			pack:       true,
+			moveOnSkip: true,
+			wantDone:   true,
+			wantStats:  runStats{skipped: 1},
+		},
+		{
+			name:         "pack check error",
+			data:         jpeg,
+			uploadErr:    errors.New("server down"),
+			pack:         true,
+			wantUpstream: true,
+		},
+		{
+			name:       "wrong id in ids file",
+			data:       jpeg,
+			uploadErr:  fmt.Errorf("a.jpg: %w", client.ErrIDMismatch),
+			fromIDs:    true,
+			wantUpload: true,
+			wantErr:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			src := &memSource{
+				files: map[string][]byte{"a.jpg": tc.data},
+				done:  make(map[string]bool),
+			}
+			up := &fakeUploader{dest: tc.dest, err: tc.uploadErr}
+			b := &batchRun{
+				src:     src,
+				up:      up,
+				breaker: &circuitBreaker{},
+
+				moveOnSkip:    tc.moveOnSkip,
+				allowAllTypes: tc.allowAll,
+				expireAfter:   tc.expire,
+				device:        "laptop",
+				album:         "trips",
+				extraMeta:     map[string]string{"camera": "x100"},
+			}
+			if tc.fromIDs {
+				b.ids = map[string]string{"a.jpg": jpegID}
+			}
+			if tc.known {
+				b.known = map[string]bool{jpegID: true}
+			}
+			if tc.pack {
+				b.pk = &packer{maxBytes: 1 << 20}
+				b.packMaxFileSize = 1 << 20
+			}
+
+			err := b.processFile(context.Background(), 1, "a.jpg")
+			switch {
+			case tc.wantUpstream:
+				if !isUpstreamErr(err) {
+					t.Fatalf("err = %v, want an upstream error", err)
+				}
+			case tc.wantChanged:
+				if !errors.Is(err, client.ErrFileChanged) {
+					t.Fatalf("err = %v, want ErrFileChanged", err)
+				}
+			case tc.wantErr:
+				if err == nil || isUpstreamErr(err) || errors.Is(err, client.ErrFileChanged) {
+					t.Fatalf("err = %v, want a local file error", err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			}
+
+			if got := len(up.uploads) > 0; got != tc.wantUpload {
+				t.Errorf("uploaded = %v, want %v", got, tc.wantUpload)
+			}
+			if tc.wantUpload {
+				meta := up.uploads[0]
+				if bytes.Equal(tc.data, jpeg) && meta.ID != jpegID {
+					t.Errorf("meta id = %s, want %s", meta.ID, jpegID)
+				}
+				if meta.Name != "a.jpg" || meta.Device != "laptop" || meta.Album != "trips" || meta.Extra["camera"] != "x100" {
+					t.Errorf("unexpected meta %+v", meta)
+				}
+				if meta.ExpireAfter != tc.wantExpire {
+					t.Errorf("meta expire_after = %q, want %q", meta.ExpireAfter, tc.wantExpire)
+				}
+			}
+			if got := b.pk != nil && len(b.pk.files) > 0; got != tc.wantPacked {
+				t.Errorf("packed = %v, want %v", got, tc.wantPacked)
+			}
+			if src.done["a.jpg"] != tc.wantDone {
+				t.Errorf("done = %v, want %v", src.done["a.jpg"], tc.wantDone)
+			}
+			if b.stats != tc.wantStats {
+				t.Errorf("stats = %+v, want %+v", b.stats, tc.wantStats)
+			}
+		})
+	}
+}
+
+func TestPlanNotMediaUsesCaptureTime(t *testing.T) {
+	captured := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	b := &batchRun{
+		src: &memSource{
+			files: map[string][]byte{"notes.txt": []byte("hello")},
+			done:  make(map[string]bool),
+		},
+		up:       &fakeUploader{},
+		breaker:  &circuitBreaker{},
+		planning: true,
+		exifTime: true,
+		captured: map[string]capturedTime{
+			"notes.txt": {t: captured, source: timeSourceEXIF},
+		},
+	}
+
+	err := b.processFile(context.Background(), 1, "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.plan) != 1 {
+		t.Fatalf("plan = %+v, want one entry", b.plan)
+	}
+	e := b.plan[0]
+	if e.Decision != planNotMedia || !e.Mtime.Equal(captured) || e.MtimeSource != timeSourceEXIF {
+		t.Errorf("plan entry = %+v, want not-media at the exif capture time", e)
+	}
+}
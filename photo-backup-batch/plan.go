@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+type planDecision string
+
+var (
+	planUpload    planDecision = "upload"
+	planSkip      planDecision = "skip"
+	planSkipKnown planDecision = "skip-known-id"
+	planSkipDone  planDecision = "skip-in-done-dir"
+	planNotMedia  planDecision = "not-media"
+	planTooOld    planDecision = "excluded-too-old"
+	planReject    planDecision = "reject"
+)
+
+// planEntry is one file's row in the -plan-out output.
+type planEntry struct {
+	Path        string       `json:"path"`
+	ID          string       `json:"id,omitempty"`
+	ContentType string       `json:"content_type"`
+	Mtime       time.Time    `json:"mtime"`
+	MtimeSource timeSource   `json:"mtime_source"`
+	Key         string       `json:"key,omitempty"`
+	Decision    planDecision `json:"decision"`
+	ErrorCode   string       `json:"error_code,omitempty"` // why the server would reject the file
+}
+
+func writePlan(path string, plan []planEntry) error {
+	if plan == nil {
+		plan = []planEntry{}
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
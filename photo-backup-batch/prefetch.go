@@ -0,0 +1,51 @@
+package main
+
+import "time"
+
+// hashPrefetch is the id of a file computed in the background while the
+// previous file uploads, for -prefetch-hash.
+type hashPrefetch struct {
+	name string
+	done chan struct{}
+
+	size        int64
+	mtime       time.Time
+	id          string
+	contentType string
+	err         error
+}
+
+// startPrefetch starts computing the id of name in the background.
+func (b *batchRun) startPrefetch(name string) *hashPrefetch {
+	p := &hashPrefetch{
+		name: name,
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		f, err := b.src.open(name)
+		if err != nil {
+			p.err = err
+			return
+		}
+		defer f.Close()
+		p.size = f.Size()
+		p.mtime = f.ModTime()
+		p.id, p.contentType, p.err = fileID(b.src, name, f, b.ids, b.hashes)
+	}()
+	return p
+}
+
+// fileID returns the id and content-type of fname, waiting for its
+// prefetch if there is one. A prefetch that failed or saw a different
+// size or mtime than f is ignored and the id is computed again.
+func (b *batchRun) fileID(fname string, f sourceFile) (string, string, error) {
+	if p := b.prefetch; p != nil && p.name == fname {
+		b.prefetch = nil
+		<-p.done
+		if p.err == nil && p.size == f.Size() && p.mtime.Equal(f.ModTime()) {
+			return p.id, p.contentType, nil
+		}
+	}
+	return fileID(b.src, fname, f, b.ids, b.hashes)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+)
+
+// rawContentTypes are the content-types of common RAW formats, which
+// http.DetectContentType doesn't recognize.
+var rawContentTypes = map[string]string{
+	".arw": "image/x-sony-arw",
+	".cr2": "image/x-canon-cr2",
+	".cr3": "image/x-canon-cr3",
+	".dng": "image/x-adobe-dng",
+	".nef": "image/x-nikon-nef",
+	".orf": "image/x-olympus-orf",
+	".raf": "image/x-fuji-raf",
+	".rw2": "image/x-panasonic-rw2",
+}
+
+// rawContentType returns the content-type to upload a RAW file with when
+// sniffing it didn't find an image type.
+func rawContentType(name, sniffed string) string {
+	if strings.HasPrefix(sniffed, "image/") {
+		return sniffed
+	}
+	if ct, ok := rawContentTypes[strings.ToLower(path.Ext(name))]; ok {
+		return ct
+	}
+	return "image/x-raw"
+}
+
+// parseExtensions parses a comma separated list of file extensions into
+// lowercase extensions with a leading dot.
+func parseExtensions(raw string) []string {
+	var exts []string
+	for _, ext := range strings.Split(raw, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts = append(exts, ext)
+	}
+	return exts
+}
+
+func hasExt(name string, exts []string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, e := range exts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRawPairs finds JPEGs with a RAW file of the same name next to
+// them. It returns a map from each file of a pair to the other one.
+func matchRawPairs(files []string, rawExts []string) map[string]string {
+	type pair struct{ jpeg, raw string }
+	byStem := make(map[string]*pair)
+	for _, f := range files {
+		isJPEG := hasExt(f, []string{".jpg", ".jpeg"})
+		if !isJPEG && !hasExt(f, rawExts) {
+			continue
+		}
+		stem := strings.ToLower(strings.TrimSuffix(f, path.Ext(f)))
+		p := byStem[stem]
+		if p == nil {
+			p = &pair{}
+			byStem[stem] = p
+		}
+		if isJPEG && p.jpeg == "" {
+			p.jpeg = f
+		} else if !isJPEG && p.raw == "" {
+			p.raw = f
+		}
+	}
+
+	partner := make(map[string]string)
+	for _, p := range byStem {
+		if p.jpeg != "" && p.raw != "" {
+			partner[p.jpeg] = p.raw
+			partner[p.raw] = p.jpeg
+		}
+	}
+	return partner
+}
+
+// withoutExtensions returns a copy of c that doesn't treat exts as
+// sidecars, so both halves of a RAW+JPEG pair are uploaded.
+func (c *sidecarConfig) withoutExtensions(exts []string) *sidecarConfig {
+	out := *c
+	out.Extensions = nil
+outer:
+	for _, ext := range c.Extensions {
+		for _, raw := range exts {
+			if ext == raw {
+				log15.Warn("sidecar_extension_is_raw", "extension", ext)
+				continue outer
+			}
+		}
+		out.Extensions = append(out.Extensions, ext)
+	}
+	return &out
+}
+
+// pairID returns the value of the pair-id metadata for fname: the id of
+// the pair's JPEG, so both files carry the same value.
+func (b *batchRun) pairID(fname, id string) (string, error) {
+	partner := b.pairs[fname]
+	if hasExt(fname, []string{".jpg", ".jpeg"}) {
+		return id, nil
+	}
+	f, err := b.src.open(partner)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	jpegID, _, err := fileID(b.src, partner, f, b.ids, b.hashes)
+	return jpegID, err
+}
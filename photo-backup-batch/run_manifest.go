@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/photo-backup-lambda/client"
+)
+
+// runManifest is the record of a run written with -write-run-manifest.
+type runManifest struct {
+	Started    time.Time         `json:"started"`
+	Finished   time.Time         `json:"finished"`
+	Device     string            `json:"device"`
+	PendingDir string            `json:"pending_dir"`
+	TestUpload bool              `json:"test_upload"`
+	Uploaded   int               `json:"uploaded"`
+	Skipped    int               `json:"skipped"`
+	Failed     int               `json:"failed"`
+	Files      []runManifestFile `json:"files"`
+}
+
+type runManifestFile struct {
+	Path   string `json:"path"`
+	ID     string `json:"id"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	Status string `json:"status"`         // uploaded or skipped
+	Pack   bool   `json:"pack,omitempty"` // stored inside the pack at Key
+}
+
+// add records a file the server stored or already had. It is a no-op on
+// a nil manifest.
+func (m *runManifest) add(fname, id, key string, size int64, status client.Status, pack bool) {
+	if m == nil {
+		return
+	}
+	f := runManifestFile{
+		Path:   fname,
+		ID:     id,
+		Key:    key,
+		Size:   size,
+		Status: "uploaded",
+		Pack:   pack,
+	}
+	if status == client.StatusSkipUpload {
+		f.Status = "skipped"
+	}
+	m.Files = append(m.Files, f)
+}
+
+// write uploads the manifest under prefix. It is best effort: failures
+// are logged and don't fail the run.
+func (m *runManifest) write(ctx context.Context, c *client.Client, prefix string, stats *runStats) {
+	m.Finished = time.Now()
+	m.Uploaded = stats.uploaded
+	m.Skipped = stats.skipped
+	m.Failed = stats.failed + stats.timedOut
+
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		log15.Warn("run_manifest_err", "err", err)
+		return
+	}
+	name := m.Started.UTC().Format("2006-01-02T15-04-05Z") + "-" + strings.ReplaceAll(m.Device, "/", "_") + ".json"
+
+	key, err := c.WriteRunManifest(ctx, prefix, name, body)
+	if err != nil {
+		log15.Warn("run_manifest_write_err", "name", name, "err", err)
+		return
+	}
+	log15.Info("run_manifest_written", "key", key, "files", len(m.Files))
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// sidecarConfig controls which sidecar files are read and which of their
+// fields are stored as object metadata.
+type sidecarConfig struct {
+	// Extensions are the sidecar extensions looked for next to each file,
+	// both as name.jpg.xmp and name.xmp.
+	Extensions []string `json:"extensions"`
+	// Fields maps a metadata key to the sidecar field whose value is
+	// stored under it. XMP fields are matched by local name (e.g. "Rating"
+	// for xmp:Rating); JSON fields are dot separated paths.
+	Fields map[string]string `json:"fields"`
+}
+
+var defaultSidecarConfig = sidecarConfig{
+	Extensions: []string{".xmp"},
+	Fields: map[string]string{
+		"rating":  "Rating",
+		"tags":    "subject",
+		"caption": "description",
+	},
+}
+
+func loadSidecarConfig(path string) (*sidecarConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf sidecarConfig
+	err = json.Unmarshal(data, &conf)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s err: %w", path, err)
+	}
+	if len(conf.Extensions) == 0 {
+		conf.Extensions = defaultSidecarConfig.Extensions
+	}
+	if len(conf.Fields) == 0 {
+		return nil, fmt.Errorf("%s: fields is required", path)
+	}
+	for i, ext := range conf.Extensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		conf.Extensions[i] = ext
+	}
+	return &conf, nil
+}
+
+// matchSidecars pairs files with their sidecars. It returns the files with
+// the matched sidecars removed, and a map from file to sidecar name.
+func (c *sidecarConfig) matchSidecars(files []string) ([]string, map[string]string) {
+	byLower := make(map[string]string, len(files))
+	for _, f := range files {
+		byLower[strings.ToLower(f)] = f
+	}
+
+	sidecars := make(map[string]string)
+	isSidecar := make(map[string]bool)
+	for _, f := range files {
+		lower := strings.ToLower(f)
+		if c.isSidecarExt(lower) {
+			continue
+		}
+		stem := strings.TrimSuffix(lower, path.Ext(lower))
+		for _, ext := range c.Extensions {
+			if sc, ok := byLower[lower+ext]; ok {
+				sidecars[f] = sc
+				isSidecar[sc] = true
+				break
+			}
+			if sc, ok := byLower[stem+ext]; ok {
+				sidecars[f] = sc
+				isSidecar[sc] = true
+				break
+			}
+		}
+	}
+
+	media := make([]string, 0, len(files)-len(isSidecar))
+	for _, f := range files {
+		if !isSidecar[f] {
+			media = append(media, f)
+		}
+	}
+	return media, sidecars
+}
+
+func (c *sidecarConfig) isSidecarExt(name string) bool {
+	ext := path.Ext(name)
+	for _, e := range c.Extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// read opens and parses the sidecar name from src.
+func (c *sidecarConfig) read(src source, name string) (map[string]string, error) {
+	f, err := src.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return c.metadata(name, f)
+}
+
+// markDone marks fname and its sidecar, if any, as done.
+func markDone(src source, fname, sidecar string) error {
+	err := src.markDone(fname)
+	if err != nil {
+		return err
+	}
+	if sidecar != "" {
+		return src.markDone(sidecar)
+	}
+	return nil
+}
+
+// metadata parses a sidecar and returns the configured fields. Fields with
+// several values (e.g. XMP tag bags) are joined with commas.
+func (c *sidecarConfig) metadata(name string, r io.Reader) (map[string]string, error) {
+	var (
+		values map[string][]string
+		err    error
+	)
+	if strings.EqualFold(path.Ext(name), ".json") {
+		values, err = jsonSidecarValues(r)
+	} else {
+		values, err = xmpSidecarValues(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse sidecar %s err: %w", name, err)
+	}
+
+	keys := make([]string, 0, len(c.Fields))
+	for key := range c.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	md := make(map[string]string)
+	for _, key := range keys {
+		if v := values[c.Fields[key]]; len(v) > 0 {
+			md[key] = strings.Join(v, ",")
+		}
+	}
+	return md, nil
+}
+
+const rdfNS = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+
+// xmpSidecarValues collects the values in an XMP packet by property local
+// name. Properties may be rdf:Description attributes or elements; text
+// inside rdf containers (Bag, Seq, Alt) belongs to the enclosing property.
+func xmpSidecarValues(r io.Reader) (map[string][]string, error) {
+	values := make(map[string][]string)
+	dec := xml.NewDecoder(r)
+
+	var stack []xml.Name
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name)
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" || attr.Name.Space == rdfNS || attr.Name.Space == "xml" {
+					continue
+				}
+				values[attr.Name.Local] = append(values[attr.Name.Local], attr.Value)
+			}
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			text := strings.TrimSpace(string(t))
+			if text == "" {
+				continue
+			}
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].Space != rdfNS {
+					values[stack[i].Local] = append(values[stack[i].Local], text)
+					break
+				}
+			}
+		}
+	}
+}
+
+// jsonSidecarValues flattens a JSON document into values keyed by dot
+// separated path. Arrays contribute one value per element.
+func jsonSidecarValues(r io.Reader) (map[string][]string, error) {
+	var doc interface{}
+	err := json.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]string)
+	var walk func(v interface{}, p string)
+	walk = func(v interface{}, p string) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for k, child := range t {
+				if p != "" {
+					k = p + "." + k
+				}
+				walk(child, k)
+			}
+		case []interface{}:
+			for _, child := range t {
+				walk(child, p)
+			}
+		case nil:
+		default:
+			values[p] = append(values[p], fmt.Sprint(t))
+		}
+	}
+	walk(doc, "")
+	return values, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/psanford/photo-backup-lambda/client"
+	"github.com/psanford/photo-backup-lambda/internal/clitool"
+)
+
+// source is where the batch tool reads pending files from.
+type source interface {
+	// list returns the names of the pending files, sorted.
+	list() ([]string, error)
+	open(name string) (sourceFile, error)
+	// markDone is called after a file has been uploaded (or skipped).
+	markDone(name string) error
+}
+
+type sourceFile interface {
+	io.ReadSeeker
+	io.Closer
+	Size() int64
+	ModTime() time.Time
+}
+
+// newSource returns the source for pendingDir. A readOnly source does not
+// require or create doneDir.
+func newSource(pendingDir, doneDir, region string, readOnly bool) (source, error) {
+	if strings.HasPrefix(pendingDir, "s3://") {
+		bucketPrefix := strings.SplitN(strings.TrimPrefix(pendingDir, "s3://"), "/", 2)
+		if bucketPrefix[0] == "" {
+			return nil, fmt.Errorf("invalid s3 source %q, expected s3://bucket/prefix", pendingDir)
+		}
+		var prefix string
+		if len(bucketPrefix) > 1 {
+			prefix = bucketPrefix[1]
+		}
+
+		sess := session.Must(session.NewSession())
+		return &s3Source{
+			s3:     s3.New(sess, aws.NewConfig().WithRegion(region)),
+			bucket: bucketPrefix[0],
+			prefix: prefix,
+		}, nil
+	}
+
+	if !readOnly {
+		if doneDir == "" {
+			return nil, errors.New("-done_dir is required")
+		}
+		err := os.MkdirAll(doneDir, 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &localSource{
+		pendingDir: pendingDir,
+		doneDir:    doneDir,
+	}, nil
+}
+
+type localSource struct {
+	pendingDir string
+	doneDir    string
+}
+
+func (s *localSource) list() ([]string, error) {
+	files, err := os.ReadDir(s.pendingDir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.Name()
+	}
+	return names, nil
+}
+
+// open returns a client.ReopenReader, so upload retries read from a
+// fresh file handle.
+func (s *localSource) open(name string) (sourceFile, error) {
+	return client.OpenFile(filepath.Join(s.pendingDir, name))
+}
+
+func (s *localSource) markDone(name string) error {
+	return os.Rename(filepath.Join(s.pendingDir, name), filepath.Join(s.doneDir, name))
+}
+
+// inDone reports whether done_dir already has a file with the same name,
+// size and mtime as f. markDone keeps the mtime, so this is a file an
+// earlier run moved there.
+func (s *localSource) inDone(name string, f sourceFile) bool {
+	stat, err := os.Stat(filepath.Join(s.doneDir, name))
+	if err != nil || !stat.Mode().IsRegular() {
+		return false
+	}
+	return stat.Size() == f.Size() && stat.ModTime().Equal(f.ModTime())
+}
+
+// checkDoneFree returns an error if the done_dir filesystem has less
+// than min bytes available.
+func (s *localSource) checkDoneFree(min int64) error {
+	free, err := clitool.FreeSpace(s.doneDir)
+	if err != nil {
+		return fmt.Errorf("check free space in %s err: %w", s.doneDir, err)
+	}
+	if free < uint64(min) {
+		return fmt.Errorf("done_dir %s has %d bytes free, below -min-done-free %d", s.doneDir, free, min)
+	}
+	return nil
+}
+
+// s3Source reads pending files from objects under an s3://bucket/prefix.
+// Source objects are left in place once uploaded.
+type s3Source struct {
+	s3     *s3.S3
+	bucket string
+	prefix string
+}
+
+func (s *s3Source) list() ([]string, error) {
+	var names []string
+	err := s.s3.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &s.bucket,
+		Prefix: &s.prefix,
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if strings.HasSuffix(*obj.Key, "/") {
+				continue
+			}
+			names = append(names, strings.TrimPrefix(*obj.Key, s.prefix))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *s3Source) open(name string) (sourceFile, error) {
+	key := s.prefix + name
+	head, err := s.s3.HeadObject(&s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{
+		s3:      s.s3,
+		bucket:  s.bucket,
+		key:     key,
+		size:    aws.Int64Value(head.ContentLength),
+		modTime: aws.TimeValue(head.LastModified),
+	}, nil
+}
+
+func (s *s3Source) markDone(name string) error {
+	return nil
+}
+
+// s3File is an io.ReadSeeker over an S3 object. Reads are streamed from a
+// ranged GetObject starting at the current offset; seeking closes the
+// current stream so the next read starts a new one.
+type s3File struct {
+	s3      *s3.S3
+	bucket  string
+	key     string
+	size    int64
+	modTime time.Time
+
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *s3File) Size() int64        { return f.size }
+func (f *s3File) ModTime() time.Time { return f.modTime }
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		out, err := f.s3.GetObject(&s3.GetObjectInput{
+			Bucket: &f.bucket,
+			Key:    &f.key,
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", f.offset)),
+		})
+		if err != nil {
+			return 0, err
+		}
+		f.body = out.Body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = f.offset + offset
+	case io.SeekEnd:
+		abs = f.size + offset
+	default:
+		return 0, errors.New("s3File.Seek: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("s3File.Seek: negative position")
+	}
+	if abs != f.offset {
+		f.closeBody()
+	}
+	f.offset = abs
+	return abs, nil
+}
+
+func (f *s3File) Close() error {
+	f.closeBody()
+	return nil
+}
+
+func (f *s3File) closeBody() {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+}
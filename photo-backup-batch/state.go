@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/photo-backup-lambda/client"
+)
+
+// uploadState is the -state-file journal. It makes moving a file to
+// done_dir the step that commits its upload:
+//
+//   - once the server has the file, an entry recording the response is
+//     appended and synced before any side effect (the thumbnail upload,
+//     the run manifest entry, the rename)
+//   - the rename to done_dir is the commit; a done record is appended
+//     after it and drops the entry
+//
+// A file that is still pending with an entry matching its size and mtime
+// was uploaded by a run that died before committing it. The next run
+// finishes it from the entry, without asking the server again and without
+// repeating a thumbnail upload the entry says already happened, so each
+// file goes through its side effects once per commit. A crash in the
+// middle of a side effect can still repeat that one step, and files
+// uploaded in packs are not journaled.
+type uploadState struct {
+	path    string
+	f       *os.File
+	entries map[string]*stateEntry
+}
+
+// stateEntry is one journal line; the last line for a path wins.
+type stateEntry struct {
+	Path        string              `json:"path"`
+	Done        bool                `json:"done,omitempty"`
+	Size        int64               `json:"size,omitempty"`
+	ModTime     time.Time           `json:"mod_time"`
+	Key         string              `json:"key,omitempty"`
+	Status      client.Status       `json:"status,omitempty"`
+	Thumbnailed bool                `json:"thumbnailed,omitempty"`
+	Meta        client.FileMetadata `json:"meta"`
+}
+
+// openUploadState loads the journal at path and rewrites it without the
+// entries of committed files.
+func openUploadState(path string) (*uploadState, error) {
+	s := &uploadState{
+		path:    path,
+		entries: make(map[string]*stateEntry),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e stateEntry
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			// the tail of a write a crash interrupted
+			log15.Warn("state_file_bad_line", "path", path, "err", err)
+			continue
+		}
+		if e.Done {
+			delete(s.entries, e.Path)
+			continue
+		}
+		s.entries[e.Path] = &e
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var compacted bytes.Buffer
+	for _, e := range s.entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		compacted.Write(append(line, '\n'))
+	}
+	err = writeFileAtomic(path, compacted.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	s.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.entries) > 0 {
+		log15.Info("state_file_uncommitted", "path", path, "files", len(s.entries))
+	}
+	return s, nil
+}
+
+// uploaded returns the entry of a file an earlier run uploaded but didn't
+// commit, if f is still the file it uploaded. It is a no-op on a nil
+// uploadState.
+func (s *uploadState) uploaded(name string, f sourceFile) (*stateEntry, bool) {
+	if s == nil {
+		return nil, false
+	}
+	e, ok := s.entries[name]
+	if !ok || e.Size != f.Size() || !e.ModTime.Equal(f.ModTime()) {
+		return nil, false
+	}
+	return e, true
+}
+
+// record durably appends e to the journal.
+func (s *uploadState) record(e *stateEntry) error {
+	if s == nil {
+		return nil
+	}
+	s.entries[e.Path] = e
+	return s.append(e)
+}
+
+// done records that name's rename to done_dir has happened.
+func (s *uploadState) done(name string) error {
+	if s == nil {
+		return nil
+	}
+	delete(s.entries, name)
+	return s.append(&stateEntry{Path: name, Done: true})
+}
+
+func (s *uploadState) append(e *stateEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.f.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *uploadState) close() error {
+	if s == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// syncDir flushes a rename into dir to disk, so a file the journal says
+// was committed can't reappear in pending after a power failure.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
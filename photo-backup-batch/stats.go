@@ -0,0 +1,46 @@
+package main
+
+import "github.com/inconshreveable/log15"
+
+// fileError is a file that failed in a -on-error continue run.
+type fileError struct {
+	name string
+	err  error
+}
+
+// runStats are the counters reported in the summary at the end of a run.
+type runStats struct {
+	uploaded     int
+	skipped      int
+	notMedia     int
+	tooOld       int
+	timedOut     int
+	changed      int
+	failed       int
+	exifFallback int
+	thumbnails   int
+	packs        int
+
+	// hitMaxFiles is set when the run stopped early at -max-files.
+	hitMaxFiles bool
+	// readOnly is set when the run stopped early because the server is
+	// in a read-only maintenance window.
+	readOnly bool
+}
+
+func (s *runStats) log() {
+	log15.Info("run_summary",
+		"uploaded", s.uploaded,
+		"skipped", s.skipped,
+		"not_media", s.notMedia,
+		"excluded_too_old", s.tooOld,
+		"timed_out", s.timedOut,
+		"changed_during_upload", s.changed,
+		"failed", s.failed,
+		"exif_fallback", s.exifFallback,
+		"thumbnails", s.thumbnails,
+		"packs", s.packs,
+		"stopped_at_max_files", s.hitMaxFiles,
+		"stopped_server_read_only", s.readOnly,
+	)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// streamBatch is how many directory entries -stream-listing reads at a
+// time, and the most names it buffers ahead of the upload loop.
+const streamBatch = 1000
+
+// stream lists pendingDir in batches in the background, in directory
+// order, sending names on a bounded channel so uploads start before the
+// whole directory has been read.
+func (s *localSource) stream() *fileQueue {
+	names := make(chan string, streamBatch)
+	q := &fileQueue{names: names}
+	go func() {
+		defer close(names)
+		dir, err := os.Open(s.pendingDir)
+		if err != nil {
+			q.streamErr = err
+			return
+		}
+		defer dir.Close()
+		for {
+			entries, err := dir.ReadDir(streamBatch)
+			for _, e := range entries {
+				names <- e.Name()
+			}
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				q.streamErr = err
+				return
+			}
+		}
+	}()
+	return q
+}
+
+// fileQueue yields the files of a run, from a listing or from stream.
+type fileQueue struct {
+	files []string
+	names <-chan string
+	// streamErr is set before names is closed.
+	streamErr error
+
+	peeked    string
+	hasPeeked bool
+}
+
+func (q *fileQueue) pop() (string, bool) {
+	if q.hasPeeked {
+		q.hasPeeked = false
+		return q.peeked, true
+	}
+	if q.names != nil {
+		name, ok := <-q.names
+		return name, ok
+	}
+	if len(q.files) == 0 {
+		return "", false
+	}
+	name := q.files[0]
+	q.files = q.files[1:]
+	return name, true
+}
+
+// peek returns the file pop will return next.
+func (q *fileQueue) peek() (string, bool) {
+	if !q.hasPeeked {
+		name, ok := q.pop()
+		if !ok {
+			return "", false
+		}
+		q.peeked, q.hasPeeked = name, true
+	}
+	return q.peeked, true
+}
+
+// err is the error that ended a stream early, once pop has returned false.
+func (q *fileQueue) err() error {
+	return q.streamErr
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/photo-backup-lambda/client"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// thumbnailSuffix is appended to the original's name; the server stores
+// the thumbnail at the original's key plus the same suffix.
+const thumbnailSuffix = ".thumb.jpg"
+
+// embeddedThumbnail returns the JPEG thumbnail embedded in r's EXIF data,
+// or nil if there isn't one.
+func embeddedThumbnail(r io.ReadSeeker) ([]byte, error) {
+	_, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	x, err := exif.Decode(r)
+	if err != nil {
+		return nil, nil
+	}
+	thumb, err := x.JpegThumbnail()
+	if err != nil {
+		return nil, nil
+	}
+	return thumb, nil
+}
+
+// uploadThumbnail uploads the embedded thumbnail of f, if it has one, as
+// the companion of the original stored at key. Failures are logged but
+// don't fail the original's upload.
+func uploadThumbnail(ctx context.Context, c uploader, f sourceFile, key string, meta client.FileMetadata) bool {
+	lgr := log15.New("name", meta.Name, "thumbnail_of", key)
+	if !strings.HasPrefix(meta.ContentType, "image/jpeg") {
+		return false
+	}
+
+	thumb, err := embeddedThumbnail(f)
+	if err != nil {
+		lgr.Warn("thumbnail_read_err", "err", err)
+		return false
+	}
+	if thumb == nil {
+		lgr.Debug("no_embedded_thumbnail")
+		return false
+	}
+
+	sum := sha256.Sum256(thumb)
+	dest, err := c.Upload(ctx, bytes.NewReader(thumb), client.FileMetadata{
+		ID:          hex.EncodeToString(sum[:]),
+		Name:        meta.Name + thumbnailSuffix,
+		Mtime:       meta.Mtime,
+		Bytes:       int64(len(thumb)),
+		ContentType: "image/jpeg",
+		TestUpload:  meta.TestUpload,
+		Device:      meta.Device,
+		ExpireAfter: meta.ExpireAfter,
+		ThumbnailOf: key,
+	})
+	if err != nil {
+		lgr.Warn("thumbnail_upload_err", "err", err)
+		return false
+	}
+	if dest.Status == client.StatusSkipUpload {
+		lgr.Debug("thumbnail_already_exists", "key", dest.Key)
+		return false
+	}
+	lgr.Info("thumbnail_uploaded", "key", dest.Key)
+	return true
+}
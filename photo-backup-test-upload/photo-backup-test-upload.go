@@ -1,36 +1,75 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/psanford/photo-backup-lambda/client"
+	"github.com/psanford/photo-backup-lambda/internal/clitool"
 )
 
 var (
 	url      = flag.String("url", "", "URL of upload_request handler")
 	username = flag.String("username", "", "Basic auth username")
 	password = flag.String("password", "", "Basic auth password")
-	file     = flag.String("file", "", "Path to file to upload")
+	passFile = flag.String("password-file", "", "Path to file containing basic auth password")
+	file     = flag.String("file", "", "Path to file to upload, or - to read from stdin")
+	tmpDir   = flag.String("tmp-dir", "", "Directory to spool stdin uploads to (default is the system temp dir)")
+
+	configFromSSM = flag.String("config-from-ssm", "", "Read the url, username and password from SSM parameters under this prefix; flags that are set take precedence")
+	ssmRegion     = flag.String("ssm-region", "us-east-1", "AWS region of the -config-from-ssm parameters")
+
+	precomputedID = flag.String("id", "", "Precomputed sha256 of the file; skips hashing it locally (s3 rejects the upload if it is wrong)")
+
+	contentType  = flag.String("content-type", "", "Content-type to upload with (default is to detect it)")
+	uploadMethod = flag.String("upload-method", "PUT", "Upload with a presigned PUT or an S3 POST policy form: PUT|POST")
+	album        = flag.String("album", "", "Store the upload under this album sub-prefix; the server must list it in allowedAlbums")
+
+	clientCert    = flag.String("client-cert", "", "Client TLS certificate file for mutual TLS")
+	clientKey     = flag.String("client-key", "", "Client TLS key file for mutual TLS")
+	testUpload    = flag.Bool("test", false, "Mark uploads as test uploads")
+	device        = flag.String("device", clitool.Hostname(), "Device name recorded with each upload")
+	expireAfter   = flag.Duration("expire-after", 0, "Have the upload deleted by the bucket lifecycle after this long (0 keeps it)")
+	http2         = flag.Bool("http2", true, "Use HTTP/2 when the server supports it")
+	logLevel      = flag.String("log-level", "info", "Log level: debug|info|warn|error|crit")
+	debug         = flag.Bool("debug", false, "Enable debug logging, including http request tracing")
+	quiet         = flag.Bool("quiet", false, "Only log warnings and errors")
+	verbose       = flag.Bool("verbose", false, "Log upload detail such as the id, content-type and object key")
+	uploadTimeout = flag.Duration("upload-timeout", 0, "Max time for a single upload attempt (0 means no limit)")
+	retries       = flag.Int("retries", 0, "Retry a failed upload this many times")
 )
 
 func main() {
 	flag.Parse()
-	err := run()
+
+	err := clitool.SetupLogging(*logLevel, *debug, *quiet, *verbose)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	err = run()
+	if err != nil {
+		log15.Crit("run_err", "err", err)
+		os.Exit(1)
 	}
 }
 
 func run() error {
+	if *configFromSSM != "" {
+		conf, err := clitool.LoadSSMConfig(*configFromSSM, *ssmRegion)
+		if err != nil {
+			return err
+		}
+		conf.Apply(url, username, password, *passFile)
+	}
+
 	if *url == "" {
 		return fmt.Errorf("-url is required")
 	}
@@ -38,145 +77,91 @@ func run() error {
 	if *file == "" {
 		return fmt.Errorf("-file is required")
 	}
-	f, err := os.Open(*file)
+	path := *file
+	if *file == "-" {
+		spooled, cleanup, err := clitool.Spool(os.Stdin, *tmpDir)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		path = spooled.Name()
+	}
+	// reopened for each retry attempt
+	f, err := client.OpenFile(path)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	summer := sha256.New()
-	_, err = io.Copy(summer, f)
-	if err != nil {
-		return err
+	var id string
+	if *precomputedID != "" {
+		id, err = client.ParseID(*precomputedID)
+	} else {
+		id, err = client.ComputeID(f)
 	}
-
-	id := hex.EncodeToString(summer.Sum(nil))
-	stat, err := f.Stat()
 	if err != nil {
 		return err
 	}
 
-	size := stat.Size()
-	mtime := stat.ModTime()
-
 	name := filepath.Base(*file)
-
-	header := make([]byte, 512)
-	f.Seek(0, io.SeekStart)
-	io.ReadFull(f, header)
-
-	contentType := http.DetectContentType(header)
-
-	dest, err := requestUploadURL(id, name, contentType, mtime, size)
-	if err != nil {
-		return err
+	if *file == "-" {
+		name = "stdin"
 	}
 
-	log.Printf("upload dest: %+v\n", dest)
-
-	if dest.Status == StatusSkipUpload {
-		log.Printf("upload already exists, skipping. id=%s", id)
-		return nil
+	meta := client.FileMetadata{
+		ID:          id,
+		Name:        name,
+		Mtime:       f.ModTime(),
+		Bytes:       f.Size(),
+		ContentType: *contentType,
+		TestUpload:  *testUpload,
+		Device:      *device,
+		Method:      strings.ToUpper(*uploadMethod),
+		Album:       *album,
 	}
-
-	f.Seek(0, io.SeekStart)
-	err = uploadFile(f, size, dest)
-	if err != nil {
-		return err
+	if *expireAfter > 0 {
+		meta.ExpireAfter = expireAfter.String()
 	}
 
-	log.Printf("Upload success!, id=%s", id)
-
-	return nil
-
-}
-
-func uploadFile(r io.Reader, size int64, dest *UploadDestination) error {
-	if dest.Method == "" {
-		dest.Method = "PUT"
-	}
-	req, err := http.NewRequest(dest.Method, dest.URL, r)
+	pass, err := clitool.ResolvePassword(*password, *passFile)
 	if err != nil {
 		return err
 	}
 
-	req.Header = dest.Headers
-	req.ContentLength = size
-
-	resp, err := http.DefaultClient.Do(req)
+	httpClient, err := clitool.NewHTTPClient(clitool.HTTPConfig{
+		CertFile: *clientCert,
+		KeyFile:  *clientKey,
+		Retries:  2,
+		HTTP2:    *http2,
+		Trace:    *debug,
+	})
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("uploadFile: non-200 status code: %d\n%s\n", resp.StatusCode, body)
-	}
-
-	return nil
-}
 
-func requestUploadURL(id, name, contentType string, mtime time.Time, size int64) (*UploadDestination, error) {
-	meta := FileMetadata{
-		ID:          id,
-		Name:        name,
-		Mtime:       mtime,
-		Bytes:       size,
-		TestUpload:  true,
-		ContentType: contentType,
-	}
-
-	jsontxt, err := json.Marshal(meta)
-	if err != nil {
-		return nil, err
-	}
-	buf := bytes.NewBuffer(jsontxt)
+	c := client.New(*url, *username, pass,
+		client.WithHTTPClient(httpClient),
+		client.WithUploadTimeout(*uploadTimeout),
+		client.WithRetries(*retries, time.Second),
+	)
 
-	req, err := http.NewRequest("POST", *url, buf)
+	dest, err := c.Upload(context.Background(), f, meta)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	req.Header.Add("content-type", "application/json")
-	req.SetBasicAuth(*username, *password)
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+	log15.Debug("upload_dest", "id", id, "content_type", meta.ContentType, "key", dest.Key, "status", dest.Status, "method", dest.Method)
 
-	if resp.StatusCode != 200 && resp.StatusCode != http.StatusConflict {
-		return nil, fmt.Errorf("non-200 status code: %d", resp.StatusCode)
+	if dest.Status == client.StatusSkipUpload {
+		log15.Info("upload_already_exists", "id", id, "key", dest.Key)
+		return nil
 	}
 
-	var dest UploadDestination
-	err = json.NewDecoder(resp.Body).Decode(&dest)
-	if err != nil {
-		return nil, err
+	if dest.MarkerErr != nil {
+		log15.Warn("marker_write_err", "key", dest.Marker.Key, "err", dest.MarkerErr)
 	}
 
-	return &dest, nil
-}
+	log15.Info("upload_success", "id", id)
 
-type UploadDestination struct {
-	Status  Status      `json:"status"`
-	Error   string      `json:"error,omitempty"`
-	URL     string      `json:"url"`
-	Method  string      `json:"method"`
-	Headers http.Header `json:"headers"`
-}
-
-type FileMetadata struct {
-	ID          string    `json:"id"`
-	Name        string    `json:"name"`
-	Mtime       time.Time `json:"mtime"`
-	Bytes       int64     `json:"size"`
-	ContentType string    `json:"content_type"`
-	TestUpload  bool      `json:"test_upload"`
+	return nil
 }
-
-type Status string
-
-var (
-	StatusOK         Status = "ok"
-	StatusSkipUpload Status = "skip" // file already exists
-	StatusErr        Status = "error"
-)
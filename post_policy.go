@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/inconshreveable/log15"
+)
+
+const (
+	uploadMethodPut  = "PUT"
+	uploadMethodPost = "POST"
+)
+
+// postPolicyTagging is the XML form of the tagging field of a POST upload.
+type postPolicyTagging struct {
+	XMLName xml.Name        `xml:"Tagging"`
+	Tags    []postPolicyTag `xml:"TagSet>Tag"`
+}
+
+type postPolicyTag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+// presignPost builds a SigV4 signed S3 POST policy for the same object
+// input would PUT. Every form field, including the metadata and the
+// x-amz-* headers a PUT would sign, is pinned with an eq condition and
+// the size with an exact content-length-range, so the form can't be
+// reused for a different object. It returns the bucket URL and the form
+// fields, which go before the file in the multipart body.
+func (s *server) presignPost(lgr log15.Logger, input *s3.PutObjectInput, extraHeaders http.Header, expiresAt time.Time) (string, map[string]string, error) {
+	client := s.presignClient()
+
+	req, _ := client.ListObjectsV2Request(&s3.ListObjectsV2Input{Bucket: input.Bucket})
+	err := req.Build()
+	if err != nil {
+		return "", nil, err
+	}
+	bucketURL := *req.HTTPRequest.URL
+	bucketURL.RawQuery = ""
+
+	creds, err := s.postPolicyCredentials(lgr, client.Config.Credentials)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := s.clock.Now().UTC()
+	date := now.Format("20060102")
+	scope := strings.Join([]string{date, aws.StringValue(client.Config.Region), "s3", "aws4_request"}, "/")
+
+	fields := map[string]string{
+		"key":                   aws.StringValue(input.Key),
+		"content-type":          aws.StringValue(input.ContentType),
+		"success_action_status": "200",
+		"x-amz-algorithm":       "AWS4-HMAC-SHA256",
+		"x-amz-credential":      creds.AccessKeyID + "/" + scope,
+		"x-amz-date":            now.Format("20060102T150405Z"),
+	}
+	if creds.SessionToken != "" {
+		fields["x-amz-security-token"] = creds.SessionToken
+	}
+	for k, v := range input.Metadata {
+		fields["x-amz-meta-"+k] = aws.StringValue(v)
+	}
+	for k := range extraHeaders {
+		k = strings.ToLower(k)
+		if k == "x-amz-tagging" {
+			tagging, err := postTaggingXML(extraHeaders.Get(k))
+			if err != nil {
+				return "", nil, err
+			}
+			fields["tagging"] = tagging
+			continue
+		}
+		fields[k] = extraHeaders.Get(k)
+	}
+
+	names := make([]string, 0, len(fields))
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	conditions := []interface{}{
+		map[string]string{"bucket": aws.StringValue(input.Bucket)},
+		[]interface{}{"content-length-range", aws.Int64Value(input.ContentLength), aws.Int64Value(input.ContentLength)},
+	}
+	for _, k := range names {
+		conditions = append(conditions, []string{"eq", "$" + k, fields[k]})
+	}
+
+	var policy bytes.Buffer
+	enc := json.NewEncoder(&policy)
+	// keep the tagging XML readable in the policy
+	enc.SetEscapeHTML(false)
+	err = enc.Encode(map[string]interface{}{
+		"expiration": expiresAt.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(policy.Bytes())
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	for _, part := range strings.Split(scope, "/")[1:] {
+		key = hmacSHA256(key, part)
+	}
+	fields["policy"] = encoded
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(key, encoded))
+
+	return bucketURL.String(), fields, nil
+}
+
+// postPolicyCredentials resolves the signing credentials, retrying like
+// presign does.
+func (s *server) postPolicyCredentials(lgr log15.Logger, creds *credentials.Credentials) (credentials.Value, error) {
+	backoff := presignBackoff
+	for attempt := 0; ; attempt++ {
+		v, err := creds.Get()
+		if err == nil {
+			return v, nil
+		}
+		if attempt >= presignRetries {
+			return v, err
+		}
+
+		lgr.Warn("presign_retry", "attempt", attempt+1, "backoff", backoff, "err", err)
+		creds.Expire()
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postTaggingXML converts an x-amz-tagging header value to the XML the
+// POST tagging field takes.
+func postTaggingXML(header string) (string, error) {
+	vals, err := neturl.ParseQuery(header)
+	if err != nil {
+		return "", err
+	}
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var tagging postPolicyTagging
+	for _, k := range keys {
+		tagging.Tags = append(tagging.Tags, postPolicyTag{k, vals.Get(k)})
+	}
+	out, err := xml.Marshal(tagging)
+	return string(out), err
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
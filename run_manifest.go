@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// maxRunManifestBytes bounds the size of a run manifest upload.
+const maxRunManifestBytes = 256 << 20
+
+// RunManifestRequest asks for a presigned PUT of a batch run's manifest
+// to <runManifestPrefix>/<user>/<prefix>/<name>.
+type RunManifestRequest struct {
+	Prefix string `json:"prefix"`
+	Name   string `json:"name"`
+	ID     string `json:"id"` // hex sha256 of the manifest
+	Bytes  int64  `json:"size"`
+}
+
+func (s *server) handleRunManifest(w http.ResponseWriter, r *http.Request) {
+	lgr := LgrFromContext(r.Context())
+
+	if r.Method != "POST" {
+		s.writeBadMethod(w)
+		return
+	}
+
+	conf := s.config()
+	if conf.runManifestPrefix == "" {
+		s.writeError(w, http.StatusNotFound, errCodeNotFound, "run manifests are not enabled")
+		return
+	}
+	if s.rejectReadOnly(w, lgr, conf) {
+		return
+	}
+
+	var req RunManifestRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMetadataBytes)).Decode(&req)
+	if err != nil {
+		lgr.Error("decode json err", "err", err)
+		s.writeError(w, http.StatusBadRequest, errCodeBadRequest, "bad request: "+err.Error())
+		return
+	}
+	lgr = lgr.New("prefix", req.Prefix, "name", req.Name, "id", req.ID, "size", req.Bytes)
+
+	checksum, err := sha256Checksum(req.ID)
+	if err != nil {
+		lgr.Error("invalid_id", "err", err)
+		s.writeError(w, http.StatusBadRequest, errCodeInvalidID, "bad request: id must be the hex encoded sha256 of the manifest")
+		return
+	}
+
+	if req.Bytes <= 0 || req.Bytes > maxRunManifestBytes {
+		lgr.Error("invalid_run_manifest_size")
+		s.writeError(w, http.StatusBadRequest, errCodeBadRequest, "bad request: size must be between 1 and "+strconv.Itoa(maxRunManifestBytes))
+		return
+	}
+
+	base := path.Join(conf.runManifestPrefix, s.userDir(r))
+	key, err := runManifestKey(base, req.Prefix, req.Name)
+	if err != nil || len(key) > maxKeyBytes {
+		lgr.Error("invalid_run_manifest_key", "err", err)
+		s.writeError(w, http.StatusBadRequest, errCodeInvalidName, "invalid run manifest prefix or name")
+		return
+	}
+	lgr = lgr.New("key", key)
+
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(conf.bucket),
+		Key:           &key,
+		ContentLength: aws.Int64(req.Bytes),
+		ContentType:   aws.String("application/json"),
+	}
+	signedHeaders := make(http.Header)
+	signedHeaders.Set("x-amz-checksum-sha256", checksum)
+
+	expiry := s.uploadExpiry(req.Bytes)
+	expiresAt := s.clock.Now().Add(expiry)
+	url, err := s.presignPut(lgr, input, signedHeaders, expiry)
+	if err != nil {
+		lgr.Error("presign_err", "err", err)
+		s.writeError(w, http.StatusInternalServerError, errCodePresignFailed, "failed to presign upload")
+		return
+	}
+
+	resp := UploadDestination{
+		Status:    StatusOK,
+		Version:   protocolVersion,
+		Key:       key,
+		URL:       url,
+		Method:    "PUT",
+		Headers:   signedHeaders,
+		ExpiresAt: &expiresAt,
+	}
+	resp.Headers.Set("content-length", strconv.FormatInt(req.Bytes, 10))
+	resp.Headers.Set("content-type", "application/json")
+
+	lgr.Info("run_manifest_request_success")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// runManifestKey joins the client's prefix and file name under base,
+// rejecting anything that would escape it.
+func runManifestKey(base, prefix, name string) (string, error) {
+	if name == "" || strings.Contains(name, "/") || !strings.HasSuffix(name, ".json") {
+		return "", errors.New("name must be a .json file name")
+	}
+	key := path.Join(base, normalizePrefix(prefix), name)
+	if !keyWithinPrefix(key, base) {
+		return "", errors.New("key outside run manifest prefix")
+	}
+	return key, nil
+}
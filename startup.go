@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/inconshreveable/log15"
+)
+
+const maxStartupBackoff = 30 * time.Second
+
+// waitReady loads the SSM config and checks that its bucket is reachable,
+// retrying with backoff for up to wait. This lets the server start before
+// its dependencies (e.g. a local S3-compatible backend) are up.
+func waitReady(kv *kv, s3client *s3.S3, wait time.Duration) (*ssmConfig, error) {
+	deadline := time.Now().Add(wait)
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		conf, err := loadSSMConfig(kv)
+		if err == nil {
+			err = checkBuckets(s3client, conf)
+			if err == nil {
+				return conf, nil
+			}
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, err
+		}
+		log15.Warn("startup_not_ready", "attempt", attempt, "backoff", backoff, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxStartupBackoff {
+			backoff = maxStartupBackoff
+		}
+	}
+}
+
+// checkBuckets checks that every configured bucket exists and is reachable.
+func checkBuckets(s3client *s3.S3, conf *ssmConfig) error {
+	for _, bucket := range conf.allBuckets() {
+		bucket := bucket
+		_, err := s3client.HeadBucket(&s3.HeadBucketInput{
+			Bucket: &bucket,
+		})
+		if err != nil {
+			return fmt.Errorf("configured bucket %s does not exist or is not accessible: %w", bucket, err)
+		}
+
+		if conf.accelerate {
+			if strings.Contains(bucket, ".") {
+				return fmt.Errorf("bucket %s can't be used with accelerate: names with dots aren't supported by the accelerate endpoint", bucket)
+			}
+			accel, err := s3client.GetBucketAccelerateConfiguration(&s3.GetBucketAccelerateConfigurationInput{
+				Bucket: &bucket,
+			})
+			if err != nil {
+				log15.Warn("get_bucket_accelerate_err", "bucket", bucket, "err", err)
+			} else if aws.StringValue(accel.Status) != s3.BucketAccelerateStatusEnabled {
+				log15.Warn("bucket_accelerate_not_enabled", "bucket", bucket, "status", aws.StringValue(accel.Status))
+			}
+		}
+	}
+	return nil
+}
+
+// isNoSuchBucket reports whether err is S3 saying the bucket doesn't
+// exist. HEAD responses have no body, so a HeadObject against a missing
+// bucket is a plain 404 that can't be told apart from a missing key; only
+// the other calls return this code.
+func isNoSuchBucket(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchBucket
+}
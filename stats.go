@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// serverStats are in-process counters served by GET /stats.
+type serverStats struct {
+	mu sync.Mutex
+
+	since          time.Time
+	requests       int64
+	totalDuration  time.Duration
+	granted        int64
+	skipped        int64
+	bytesPresigned int64
+	errors         map[string]int64
+}
+
+func newServerStats(now time.Time) *serverStats {
+	return &serverStats{
+		since:  now,
+		errors: make(map[string]int64),
+	}
+}
+
+func (st *serverStats) recordRequest(d time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.requests++
+	st.totalDuration += d
+}
+
+func (st *serverStats) recordGranted(size int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.granted++
+	st.bytesPresigned += size
+}
+
+func (st *serverStats) recordSkip() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.skipped++
+}
+
+func (st *serverStats) recordError(code string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.errors[code]++
+}
+
+// StatsResponse is returned by GET /stats.
+type StatsResponse struct {
+	Since          time.Time        `json:"since"`
+	Requests       int64            `json:"requests"`
+	UploadsGranted int64            `json:"uploads_granted"`
+	Skips          int64            `json:"skips"`
+	Errors         map[string]int64 `json:"errors"`
+	BytesPresigned int64            `json:"bytes_presigned"`
+	AvgDurationMS  float64          `json:"avg_duration_ms"`
+}
+
+// snapshot returns the current counters, resetting them if reset is set.
+func (st *serverStats) snapshot(now time.Time, reset bool) StatsResponse {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	resp := StatsResponse{
+		Since:          st.since,
+		Requests:       st.requests,
+		UploadsGranted: st.granted,
+		Skips:          st.skipped,
+		Errors:         st.errors,
+		BytesPresigned: st.bytesPresigned,
+	}
+	if st.requests > 0 {
+		resp.AvgDurationMS = float64(st.totalDuration.Milliseconds()) / float64(st.requests)
+	}
+
+	if reset {
+		st.since = now
+		st.requests = 0
+		st.totalDuration = 0
+		st.granted = 0
+		st.skipped = 0
+		st.bytesPresigned = 0
+		st.errors = make(map[string]int64)
+	} else {
+		resp.Errors = make(map[string]int64, len(st.errors))
+		for code, n := range st.errors {
+			resp.Errors[code] = n
+		}
+	}
+	return resp
+}
+
+// handleStats returns the counters since startup, or since the last
+// GET /stats?reset=true.
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		s.writeBadMethod(w)
+		return
+	}
+
+	reset, _ := strconv.ParseBool(r.URL.Query().Get("reset"))
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(s.stats.snapshot(s.clock.Now(), reset))
+}
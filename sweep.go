@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/inconshreveable/log15"
+)
+
+type sweepReport struct {
+	Aborted        int   `json:"aborted"`
+	ReclaimedBytes int64 `json:"reclaimed_bytes"` // estimated from the uploaded parts
+	Failed         int   `json:"failed"`
+}
+
+// sweepMultipartTask aborts multipart uploads under pathPrefix that were
+// initiated more than -sweep-max-age ago. Interrupted multipart uploads
+// leave orphaned parts that are billed but never complete. Nothing is
+// aborted without -apply.
+func (s *server) sweepMultipartTask(ctx context.Context) (interface{}, error) {
+	conf := s.config()
+	cutoff := s.clock.Now().Add(-*sweepMaxAge)
+
+	var report sweepReport
+	for _, bucket := range conf.allBuckets() {
+		lgr := log15.New("bucket", bucket)
+
+		var stale []*s3.MultipartUpload
+		err := s.s3.ListMultipartUploadsPagesWithContext(ctx, &s3.ListMultipartUploadsInput{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(conf.listPrefix()),
+		}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+			for _, upload := range page.Uploads {
+				if aws.TimeValue(upload.Initiated).Before(cutoff) {
+					stale = append(stale, upload)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, upload := range stale {
+			ulgr := lgr.New("key", aws.StringValue(upload.Key), "upload_id", aws.StringValue(upload.UploadId), "initiated", aws.TimeValue(upload.Initiated))
+
+			var size int64
+			err = s.s3.ListPartsPagesWithContext(ctx, &s3.ListPartsInput{
+				Bucket:   aws.String(bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+				for _, part := range page.Parts {
+					size += aws.Int64Value(part.Size)
+				}
+				return true
+			})
+			if err != nil {
+				ulgr.Warn("list_parts_err", "err", err)
+			}
+
+			if !applying() {
+				ulgr.Info("sweep_would_abort", "bytes", size)
+				report.Aborted++
+				report.ReclaimedBytes += size
+				continue
+			}
+
+			_, err = s.s3.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				ulgr.Error("abort_multipart_err", "err", err)
+				report.Failed++
+				continue
+			}
+			ulgr.Info("sweep_aborted", "bytes", size)
+			report.Aborted++
+			report.ReclaimedBytes += size
+		}
+	}
+
+	return &report, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestSweepMultipartApply(t *testing.T) {
+	defer func(a, d bool) { *apply, *dryRun = a, d }(*apply, *dryRun)
+
+	checks := []struct {
+		name       string
+		apply, dry bool
+		wantAbort  bool
+	}{
+		{"default", false, false, false},
+		{"dry run", false, true, false},
+		{"apply", true, false, true},
+		{"apply and dry run", true, true, false},
+	}
+	for _, check := range checks {
+		t.Run(check.name, func(t *testing.T) {
+			*apply, *dryRun = check.apply, check.dry
+
+			var (
+				mu      sync.Mutex
+				aborted int
+			)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == "GET" && r.URL.Query().Get("uploadId") != "":
+					fmt.Fprint(w, `<ListPartsResult><Part><PartNumber>1</PartNumber><Size>10</Size></Part></ListPartsResult>`)
+				case r.Method == "GET":
+					fmt.Fprint(w, `<ListMultipartUploadsResult><Upload><Key>photos/a.jpg</Key><UploadId>u1</UploadId><Initiated>2020-01-01T00:00:00.000Z</Initiated></Upload></ListMultipartUploadsResult>`)
+				case r.Method == "DELETE":
+					mu.Lock()
+					aborted++
+					mu.Unlock()
+					w.WriteHeader(http.StatusNoContent)
+				}
+			}))
+			defer ts.Close()
+			sess := session.Must(session.NewSession(&aws.Config{
+				Endpoint:         aws.String(ts.URL),
+				Region:           aws.String("us-east-1"),
+				Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+				S3ForcePathStyle: aws.Bool(true),
+			}))
+
+			s := &server{s3: s3.New(sess), clock: realClock{}}
+			s.conf.Store(&ssmConfig{bucket: "bucket", pathPrefix: "photos"})
+
+			out, err := s.sweepMultipartTask(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			report := out.(*sweepReport)
+			if report.Aborted != 1 || report.ReclaimedBytes != 10 {
+				t.Errorf("report = %+v, want 1 upload of 10 bytes", report)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got := aborted > 0; got != check.wantAbort {
+				t.Errorf("aborted %d uploads, want abort %t", aborted, check.wantAbort)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/inconshreveable/log15"
+)
+
+type sweepTestUploadsReport struct {
+	Checked int   `json:"checked"` // objects old enough to be candidates
+	Deleted int   `json:"deleted"`
+	Bytes   int64 `json:"bytes"`
+	Failed  int   `json:"failed"`
+}
+
+// sweepTestUploadsTask deletes objects under pathPrefix that were stored
+// with test-upload=true metadata more than -test-upload-max-age ago. Only
+// objects older than the cutoff are HEADed to read their metadata. Nothing
+// is deleted without -apply.
+func (s *server) sweepTestUploadsTask(ctx context.Context) (interface{}, error) {
+	conf := s.config()
+	cutoff := s.clock.Now().Add(-*testUploadMaxAge)
+
+	var report sweepTestUploadsReport
+	for _, bucket := range conf.allBuckets() {
+		lgr := log15.New("bucket", bucket)
+
+		var old []*s3.Object
+		err := s.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(conf.listPrefix()),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				// staged inbox uploads are sweep-inbox's
+				if aws.TimeValue(obj.LastModified).Before(cutoff) && conf.storedKey(aws.StringValue(obj.Key)) {
+					old = append(old, obj)
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range old {
+			olgr := lgr.New("key", aws.StringValue(obj.Key), "last_modified", aws.TimeValue(obj.LastModified))
+			report.Checked++
+
+			head, err := s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    obj.Key,
+			})
+			if err != nil {
+				olgr.Error("sweep_test_uploads_head_err", "err", err)
+				report.Failed++
+				continue
+			}
+			if metadataValue(head.Metadata, "test-upload") != "true" {
+				continue
+			}
+
+			if !applying() {
+				olgr.Info("sweep_test_uploads_would_delete", "bytes", aws.Int64Value(obj.Size))
+				report.Deleted++
+				report.Bytes += aws.Int64Value(obj.Size)
+				continue
+			}
+
+			_, err = s.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    obj.Key,
+			})
+			if err != nil {
+				olgr.Error("sweep_test_uploads_delete_err", "err", err)
+				report.Failed++
+				continue
+			}
+			olgr.Info("sweep_test_uploads_deleted", "bytes", aws.Int64Value(obj.Size))
+			report.Deleted++
+			report.Bytes += aws.Int64Value(obj.Size)
+		}
+	}
+
+	return &report, nil
+}
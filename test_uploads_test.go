@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeSweepS3 serves a bucket holding one old test upload at key and
+// records the keys deleted from it.
+func fakeSweepS3(t *testing.T, key string) (*s3.S3, func() []string) {
+	var (
+		mu      sync.Mutex
+		deleted []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			fmt.Fprintf(w, `<ListBucketResult><Contents><Key>%s</Key><Size>10</Size><LastModified>2020-01-01T00:00:00.000Z</LastModified></Contents></ListBucketResult>`, key)
+		case "HEAD":
+			w.Header().Set("x-amz-meta-test-upload", "true")
+		case "DELETE":
+			mu.Lock()
+			deleted = append(deleted, r.URL.Path)
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(ts.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+	}))
+	return s3.New(sess), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return deleted
+	}
+}
+
+func TestSweepTestUploadsApply(t *testing.T) {
+	defer func(a, d bool) { *apply, *dryRun = a, d }(*apply, *dryRun)
+
+	checks := []struct {
+		name       string
+		apply, dry bool
+		wantDelete bool
+	}{
+		{"default", false, false, false},
+		{"dry run", false, true, false},
+		{"apply", true, false, true},
+		{"apply and dry run", true, true, false},
+	}
+	for _, check := range checks {
+		t.Run(check.name, func(t *testing.T) {
+			*apply, *dryRun = check.apply, check.dry
+
+			client, deleted := fakeSweepS3(t, "photos/test.jpg")
+			s := &server{s3: client, clock: realClock{}}
+			s.conf.Store(&ssmConfig{bucket: "bucket", pathPrefix: "photos"})
+
+			out, err := s.sweepTestUploadsTask(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			report := out.(*sweepTestUploadsReport)
+			if report.Deleted != 1 {
+				t.Errorf("report.Deleted = %d, want 1", report.Deleted)
+			}
+			if got := len(deleted()) > 0; got != check.wantDelete {
+				t.Errorf("deleted %v, want delete %t", deleted(), check.wantDelete)
+			}
+		})
+	}
+}
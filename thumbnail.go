@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// thumbnailSuffix is appended to an original's key to form the key of its
+// thumbnail.
+const thumbnailSuffix = ".thumb.jpg"
+
+// findObject returns the configured bucket that holds the stored upload
+// at key.
+func (s *server) findObject(conf *ssmConfig, key string) (string, bool) {
+	if !conf.storedKey(key) {
+		return "", false
+	}
+	for _, bucket := range conf.allBuckets() {
+		bucket := bucket
+		_, err := s.s3.HeadObject(&s3.HeadObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+		})
+		if err == nil {
+			return bucket, true
+		}
+	}
+	return "", false
+}
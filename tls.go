@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+var (
+	clientCNContextKey = ctxKey("client-cn")
+)
+
+func serverTLSConfig(clientCAFile string) (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if clientCAFile == "" {
+		return conf, nil
+	}
+
+	caPEM, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client ca err: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+
+	conf.ClientCAs = pool
+	conf.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return conf, nil
+}
+
+// clientCertMiddleware makes the common name of a verified client
+// certificate available via ClientCNFromContext.
+func clientCertMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+			cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+			lgr := LgrFromContext(r.Context()).New("client_cn", cn)
+			ctx := context.WithValue(r.Context(), clientCNContextKey, cn)
+			ctx = WithLgrContext(ctx, lgr)
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ClientCNFromContext(ctx context.Context) string {
+	cn, _ := ctx.Value(clientCNContextKey).(string)
+	return cn
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/inconshreveable/log15"
+)
+
+type verifyMismatch struct {
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	StoredID string `json:"stored_id"`
+	ActualID string `json:"actual_id"`
+}
+
+type verifyReport struct {
+	Listed     int              `json:"listed"`
+	Checked    int              `json:"checked"`
+	Bytes      int64            `json:"bytes"`
+	MissingID  int              `json:"missing_id"` // objects without x-amz-meta-id
+	Failed     int              `json:"failed"`
+	Mismatches []verifyMismatch `json:"mismatches"`
+}
+
+// verifySampleTask downloads a random -verify-sample-percent of the objects
+// under pathPrefix, recomputes their sha256 and compares it to the id
+// stored in the object metadata.
+func (s *server) verifySampleTask(ctx context.Context) (interface{}, error) {
+	conf := s.config()
+	rate := *verifySamplePct / 100
+
+	report := verifyReport{
+		Mismatches: []verifyMismatch{},
+	}
+	for _, bucket := range conf.allBuckets() {
+		var sample []string
+		err := s.s3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(conf.listPrefix()),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				if !conf.storedKey(aws.StringValue(obj.Key)) {
+					continue
+				}
+				report.Listed++
+				if rand.Float64() < rate {
+					sample = append(sample, aws.StringValue(obj.Key))
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range sample {
+			lgr := log15.New("bucket", bucket, "key", key)
+
+			storedID, actualID, n, err := s.hashObject(ctx, bucket, key)
+			if err != nil {
+				lgr.Error("verify_get_object_err", "err", err)
+				report.Failed++
+				continue
+			}
+			report.Checked++
+			report.Bytes += n
+
+			if storedID == "" {
+				lgr.Warn("verify_missing_id", "actual_id", actualID)
+				report.MissingID++
+				continue
+			}
+			if storedID != actualID {
+				lgr.Error("verify_mismatch", "stored_id", storedID, "actual_id", actualID)
+				report.Mismatches = append(report.Mismatches, verifyMismatch{
+					Bucket:   bucket,
+					Key:      key,
+					StoredID: storedID,
+					ActualID: actualID,
+				})
+				continue
+			}
+			lgr.Debug("verify_ok", "id", actualID)
+		}
+	}
+
+	return &report, nil
+}
+
+// hashObject downloads an object and returns its stored id metadata, the
+// hex sha256 of its contents and its size.
+func (s *server) hashObject(ctx context.Context, bucket, key string) (storedID, actualID string, n int64, err error) {
+	obj, err := s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer obj.Body.Close()
+
+	h := sha256.New()
+	n, err = io.Copy(h, obj.Body)
+	if err != nil {
+		return "", "", n, err
+	}
+
+	return metadataValue(obj.Metadata, "id"), hex.EncodeToString(h.Sum(nil)), n, nil
+}